@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// PackageComponent is a part of the package that can be
+// selected or deselected at install time
+type PackageComponent struct {
+	Name     string   `json:"name"`
+	Paths    []string `json:"paths"`    // gitignore-like globs of owned files
+	Requires []string `json:"requires"` // components this one depends on
+	Default  bool     `json:"default"`  // installed unless deselected
+}
+
+type componentRule struct {
+	component string
+	re        *regexp.Regexp
+}
+
+// ComponentSet tells which package files belong to selected components;
+// files not owned by any component are always installed
+type ComponentSet struct {
+	selected map[string]bool
+	rules    []*componentRule
+}
+
+// NewComponentSet selects requested components with all their dependencies
+// or default components if nothing is requested
+func NewComponentSet(components []*PackageComponent, requested []string) (*ComponentSet, error) {
+	cs := &ComponentSet{selected: make(map[string]bool)}
+	byName := make(map[string]*PackageComponent)
+
+	for _, c := range components {
+		if len(c.Name) == 0 {
+			return nil, errors.New("component without a name in package manifest")
+		}
+
+		if _, ok := byName[c.Name]; ok {
+			return nil, fmt.Errorf("duplicate component in package manifest: %v", c.Name)
+		}
+		byName[c.Name] = c
+
+		for _, p := range c.Paths {
+			expr, err := globToRegexp(p)
+			if err != nil {
+				return nil, fmt.Errorf("component %v: invalid path %q: %v", c.Name, p, err)
+			}
+
+			cs.rules = append(cs.rules, &componentRule{
+				component: c.Name,
+				re:        regexp.MustCompile(expr),
+			})
+		}
+	}
+
+	if requested == nil {
+		for _, c := range components {
+			if c.Default {
+				requested = append(requested, c.Name)
+			}
+		}
+	}
+
+	var selectComponent func(name, requiredBy string) error
+	selectComponent = func(name, requiredBy string) error {
+		c, ok := byName[name]
+		if !ok {
+			if len(requiredBy) > 0 {
+				return fmt.Errorf("component %v requires unknown component %v", requiredBy, name)
+			}
+
+			return fmt.Errorf("unknown component: %v", name)
+		}
+
+		if cs.selected[name] {
+			return nil
+		}
+		cs.selected[name] = true
+
+		for _, dependency := range c.Requires {
+			if err := selectComponent(dependency, name); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, name := range requested {
+		if err := selectComponent(name, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	return cs, nil
+}
+
+// Includes returns true if file is not owned by any component
+// or at least one of its owners is selected
+func (cs *ComponentSet) Includes(relpath string) bool {
+	if cs == nil {
+		return true
+	}
+
+	owned := false
+
+	for _, r := range cs.rules {
+		if r.re.MatchString(relpath) {
+			if cs.selected[r.component] {
+				return true
+			}
+
+			owned = true
+		}
+	}
+
+	return !owned
+}
+
+// Selected returns sorted names of selected components
+func (cs *ComponentSet) Selected() []string {
+	if cs == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(cs.selected))
+	for name := range cs.selected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func (cs *ComponentSet) String() string {
+	return "[" + strings.Join(cs.Selected(), " ") + "]"
+}
+
+// ParseComponents parses comma-separated list of component names
+func ParseComponents(s string) []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	envPrefix     = "MINISTALLER_"
+	configFlagKey = "config"
+	// separates values of repeatable flags in environment variables
+	// (commas and spaces may be part of patterns or arguments)
+	envListSeparator = string(os.PathListSeparator)
+)
+
+// aliases for flags with names too short to be readable in config
+var configAliases = map[string]string{
+	"log-path": "l",
+}
+
+// configValue is a single setting from the config file
+type configValue struct {
+	key    string
+	values []string
+	line   int
+}
+
+// flag name -> where its value came from (for error messages)
+var flagSources = make(map[string]string)
+
+// applyConfig fills flags not set on the command line from
+// MINISTALLER_* environment variables and then from the config file
+func applyConfig() error {
+	flag.Visit(func(f *flag.Flag) {
+		flagSources[f.Name] = "-" + f.Name
+	})
+
+	err := applyEnvironment()
+	if err != nil {
+		return err
+	}
+
+	if len(*configFlag) == 0 {
+		return nil
+	}
+
+	values, err := readConfigFile(*configFlag)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range values {
+		err = applyConfigValue(*configFlag, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func applyEnvironment() error {
+	var err error
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if _, ok := flagSources[f.Name]; ok || (err != nil) {
+			return
+		}
+
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+
+		values := []string{value}
+		if _, isArray := f.Value.(*arrayFlags); isArray {
+			values = splitList(value)
+		}
+
+		for _, v := range values {
+			if serr := f.Value.Set(v); serr != nil {
+				err = configError("%v: invalid value %q: %v", name, v, serr)
+				return
+			}
+		}
+
+		flagSources[f.Name] = name
+	})
+
+	return err
+}
+
+func applyConfigValue(configPath string, v *configValue) error {
+	where := fmt.Sprintf("%v: %v", configPath, v.key)
+	if v.line > 0 {
+		where = fmt.Sprintf("%v:%v: %v", configPath, v.line, v.key)
+	}
+
+	name := strings.Replace(v.key, "_", "-", -1)
+	if alias, ok := configAliases[name]; ok {
+		name = alias
+	}
+
+	if name == configFlagKey {
+		return configError("%v: config file cannot include another config", where)
+	}
+
+	f := flag.Lookup(name)
+	if f == nil {
+		return configError("%v: unknown setting", where)
+	}
+
+	if _, ok := flagSources[name]; ok {
+		// command line and environment override the file
+		return nil
+	}
+
+	_, isArray := f.Value.(*arrayFlags)
+	if (len(v.values) == 0) && !isArray {
+		return configError("%v: missing value", where)
+	}
+	if (len(v.values) > 1) && !isArray {
+		return configError("%v: expected single value, found list", where)
+	}
+
+	for _, value := range v.values {
+		if err := f.Value.Set(value); err != nil {
+			return configError("%v: invalid value %q: %v", where, value, err)
+		}
+	}
+
+	flagSources[name] = where
+
+	return nil
+}
+
+// flagError formats validation error pointing at the source of the flag value
+func flagError(name string, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+
+	if source, ok := flagSources[name]; ok {
+		msg = fmt.Sprintf("%v: %v", source, msg)
+	}
+
+	return &ArgumentError{msg: msg}
+}
+
+// configError is returned for invalid config file or environment
+// so that they exit with the same code as invalid flags
+func configError(format string, args ...interface{}) error {
+	return &ArgumentError{msg: fmt.Sprintf(format, args...)}
+}
+
+func envName(flagName string) string {
+	for alias, name := range configAliases {
+		if name == flagName {
+			flagName = alias
+		}
+	}
+
+	return envPrefix + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+func splitList(s string) []string {
+	var result []string
+	for _, item := range strings.Split(s, envListSeparator) {
+		if len(item) > 0 {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+// listFlagUsage documents how repeatable flag is set from the environment
+func listFlagUsage(flagName, usage string) string {
+	return fmt.Sprintf("%v (can be specified multiple times or separated by %q in %v)", usage, envListSeparator, envName(flagName))
+}
+
+func readConfigFile(configPath string) ([]*configValue, error) {
+	data, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return nil, configError("%v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(configPath)) {
+	case ".json":
+		return parseJSONConfig(configPath, data)
+	case ".yaml", ".yml":
+		return parseYAMLConfig(configPath, data)
+	case ".toml":
+		return parseTOMLConfig(configPath, data)
+	default:
+		return nil, configError("%v: unsupported config format (use .json, .yaml or .toml)", configPath)
+	}
+}
+
+func parseJSONConfig(configPath string, data []byte) ([]*configValue, error) {
+	var raw map[string]interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, configError("%v: %v", configPath, err)
+	}
+
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := make([]*configValue, 0, len(raw))
+
+	for _, key := range keys {
+		v := &configValue{key: key}
+
+		switch value := raw[key].(type) {
+		case []interface{}:
+			for _, item := range value {
+				s, ok := jsonScalar(item)
+				if !ok {
+					return nil, configError("%v: %v: unsupported list item %v", configPath, key, item)
+				}
+				v.values = append(v.values, s)
+			}
+		default:
+			s, ok := jsonScalar(value)
+			if !ok {
+				return nil, configError("%v: %v: unsupported value %v", configPath, key, value)
+			}
+			v.values = []string{s}
+		}
+
+		values = append(values, v)
+	}
+
+	return values, nil
+}
+
+func jsonScalar(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+
+	return "", false
+}
+
+// parseYAMLConfig supports flat mappings with scalar values,
+// inline [a, b] lists and block lists of "- item" lines
+func parseYAMLConfig(configPath string, data []byte) ([]*configValue, error) {
+	var values []*configValue
+	var current *configValue
+	blockList := false
+
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		raw := scanner.Text()
+		line := strings.TrimSpace(stripComment(raw))
+
+		if (len(line) == 0) || (line == "---") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "- ") || (line == "-") {
+			if !blockList {
+				return nil, configError("%v:%v: list item without a key", configPath, lineNumber)
+			}
+
+			value := strings.TrimSpace(strings.TrimPrefix(line, "-"))
+			if len(value) == 0 {
+				// empty pattern would match everything
+				return nil, configError("%v:%v: %v: empty list item", configPath, lineNumber, current.key)
+			}
+
+			item, err := unquote(value)
+			if err != nil {
+				return nil, configError("%v:%v: %v: %v", configPath, lineNumber, current.key, err)
+			}
+
+			current.values = append(current.values, item)
+			continue
+		}
+
+		if isIndented(raw) {
+			return nil, configError("%v:%v: nested settings are not supported", configPath, lineNumber)
+		}
+
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			return nil, configError("%v:%v: expected \"key: value\"", configPath, lineNumber)
+		}
+
+		key := strings.TrimSpace(line[:colon])
+		current = &configValue{key: key, line: lineNumber}
+		values = append(values, current)
+
+		value := strings.TrimSpace(line[colon+1:])
+		blockList = (len(value) == 0)
+		if blockList {
+			continue
+		}
+
+		items, err := parseScalarOrList(value)
+		if err != nil {
+			return nil, configError("%v:%v: %v: %v", configPath, lineNumber, key, err)
+		}
+
+		current.values = items
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, configError("%v: %v", configPath, err)
+	}
+
+	return values, nil
+}
+
+// parseTOMLConfig supports top-level "key = value" pairs
+// with strings, numbers, booleans and single-line arrays
+func parseTOMLConfig(configPath string, data []byte) ([]*configValue, error) {
+	var values []*configValue
+
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	lineNumber := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			return nil, configError("%v:%v: tables are not supported", configPath, lineNumber)
+		}
+
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return nil, configError("%v:%v: expected \"key = value\"", configPath, lineNumber)
+		}
+
+		key, err := unquote(strings.TrimSpace(line[:eq]))
+		if err != nil {
+			return nil, configError("%v:%v: %v", configPath, lineNumber, err)
+		}
+
+		items, err := parseScalarOrList(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, configError("%v:%v: %v: %v", configPath, lineNumber, key, err)
+		}
+
+		values = append(values, &configValue{key: key, values: items, line: lineNumber})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, configError("%v: %v", configPath, err)
+	}
+
+	return values, nil
+}
+
+func parseScalarOrList(value string) ([]string, error) {
+	if !strings.HasPrefix(value, "[") {
+		item, err := unquote(value)
+		if err != nil {
+			return nil, err
+		}
+
+		return []string{item}, nil
+	}
+
+	if !strings.HasSuffix(value, "]") {
+		return nil, errors.New("unterminated list")
+	}
+
+	var items []string
+	for _, item := range splitQuoted(value[1 : len(value)-1]) {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+
+		s, err := unquote(item)
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, s)
+	}
+
+	return items, nil
+}
+
+func unquote(s string) (string, error) {
+	if (s == "\"") || (s == "'") {
+		return "", fmt.Errorf("unterminated string %v", s)
+	}
+
+	if len(s) < 2 {
+		return s, nil
+	}
+
+	switch s[0] {
+	case '"':
+		if s[len(s)-1] != '"' {
+			return "", fmt.Errorf("unterminated string %v", s)
+		}
+		return strconv.Unquote(s)
+	case '\'':
+		if s[len(s)-1] != '\'' {
+			return "", fmt.Errorf("unterminated string %v", s)
+		}
+		return s[1 : len(s)-1], nil
+	}
+
+	return s, nil
+}
+
+// splitQuoted splits by commas outside of quotes
+func splitQuoted(s string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"') || (c == '\''):
+			quote = c
+		case c == ',':
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(parts, s[start:])
+}
+
+// stripComment removes # comment outside of quotes
+func stripComment(line string) string {
+	var quote byte
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case (c == '"') || (c == '\''):
+			quote = c
+		case (c == '#') && ((i == 0) || (line[i-1] == ' ') || (line[i-1] == '\t')):
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+func isIndented(line string) bool {
+	return strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+}
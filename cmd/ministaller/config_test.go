@@ -0,0 +1,303 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func configValuesMap(values []*configValue) map[string][]string {
+	m := make(map[string][]string)
+	for _, v := range values {
+		m[v.key] = v.values
+	}
+
+	return m
+}
+
+func TestParseYAMLConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected map[string][]string
+	}{
+		{
+			name:     "scalars",
+			data:     "---\ninstall-path: /opt/app\njobs: 4\nstdout: true\n",
+			expected: map[string][]string{"install-path": {"/opt/app"}, "jobs": {"4"}, "stdout": {"true"}},
+		},
+		{
+			name:     "comments",
+			data:     "# settings\njobs: 4 # four\nexclude: \"a #b\"  # comment\nurl: http://host:8080/x#frag\n",
+			expected: map[string][]string{"jobs": {"4"}, "exclude": {"a #b"}, "url": {"http://host:8080/x#frag"}},
+		},
+		{
+			name:     "inline list",
+			data:     "exclude: [\"a,b\", 'c#d', \"e\\\"f\", g]\n",
+			expected: map[string][]string{"exclude": {"a,b", "c#d", "e\"f", "g"}},
+		},
+		{
+			name:     "block list followed by key",
+			data:     "exclude:\n  - a\n  - \"b c\"\n  - 'd # e'\njobs: 2\n",
+			expected: map[string][]string{"exclude": {"a", "b c", "d # e"}, "jobs": {"2"}},
+		},
+		{
+			name:     "empty block list",
+			data:     "exclude:\njobs: 2\n",
+			expected: map[string][]string{"exclude": nil, "jobs": {"2"}},
+		},
+	}
+
+	for _, tt := range tests {
+		values, err := parseYAMLConfig("test.yaml", []byte(tt.data))
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.name, err)
+			continue
+		}
+
+		if got := configValuesMap(values); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%v: got %q, expected %q", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestParseYAMLConfigErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		error string
+	}{
+		{"item without key", "- a\n", "test.yaml:1: list item without a key"},
+		{"item after scalar", "jobs: 2\n- a\n", "test.yaml:2: list item without a key"},
+		{"indented key", "jobs: 2\n  stdout: true\n", "test.yaml:2: nested settings are not supported"},
+		{"nested mapping", "exclude:\n  pattern: a\n", "test.yaml:2: nested settings are not supported"},
+		{"no colon", "jobs 2\n", "test.yaml:1: expected \"key: value\""},
+		{"unterminated string", "url: \"http://x\n", "test.yaml:1: url: unterminated string"},
+		{"unterminated list", "exclude: [a, b\n", "test.yaml:1: exclude: unterminated list"},
+		{"empty item", "exclude:\n  - a\n  -\n", "test.yaml:3: exclude: empty list item"},
+		{"lone quote item", "exclude:\n  - \"\n", "test.yaml:2: exclude: unterminated string"},
+	}
+
+	for _, tt := range tests {
+		_, err := parseYAMLConfig("test.yaml", []byte(tt.data))
+		if (err == nil) || !strings.HasPrefix(err.Error(), tt.error) {
+			t.Errorf("%v: got error %v, expected %v", tt.name, err, tt.error)
+		}
+	}
+}
+
+func TestParseTOMLConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected map[string][]string
+	}{
+		{
+			name:     "scalars",
+			data:     "install-path = \"/opt/app\"\njobs = 4\nstdout = true\n",
+			expected: map[string][]string{"install-path": {"/opt/app"}, "jobs": {"4"}, "stdout": {"true"}},
+		},
+		{
+			name:     "quoted key",
+			data:     "\"log-path\" = 'C:\\logs\\app.log'\n",
+			expected: map[string][]string{"log-path": {"C:\\logs\\app.log"}},
+		},
+		{
+			name:     "comments",
+			data:     "# settings\njobs = 4 # four\nexclude = \"a # b\"\n",
+			expected: map[string][]string{"jobs": {"4"}, "exclude": {"a # b"}},
+		},
+		{
+			name:     "array",
+			data:     "exclude = [\"a,b\", 'c#d', \"e\\\"f\", ] # list\n",
+			expected: map[string][]string{"exclude": {"a,b", "c#d", "e\"f"}},
+		},
+		{
+			name:     "empty array",
+			data:     "exclude = []\n",
+			expected: map[string][]string{"exclude": nil},
+		},
+	}
+
+	for _, tt := range tests {
+		values, err := parseTOMLConfig("test.toml", []byte(tt.data))
+		if err != nil {
+			t.Errorf("%v: unexpected error: %v", tt.name, err)
+			continue
+		}
+
+		if got := configValuesMap(values); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%v: got %q, expected %q", tt.name, got, tt.expected)
+		}
+	}
+}
+
+func TestParseTOMLConfigErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  string
+		error string
+	}{
+		{"table", "jobs = 2\n[install]\npath = \"/opt\"\n", "test.toml:2: tables are not supported"},
+		{"array of tables", "[[install]]\n", "test.toml:1: tables are not supported"},
+		{"no equals", "jobs 2\n", "test.toml:1: expected \"key = value\""},
+		{"unterminated string", "url = \"http://x\n", "test.toml:1: url: unterminated string"},
+		{"unterminated key", "\"url = 1\n", "test.toml:1: unterminated string"},
+		{"multiline array", "exclude = [\n  \"a\",\n]\n", "test.toml:1: exclude: unterminated list"},
+	}
+
+	for _, tt := range tests {
+		_, err := parseTOMLConfig("test.toml", []byte(tt.data))
+		if (err == nil) || !strings.HasPrefix(err.Error(), tt.error) {
+			t.Errorf("%v: got error %v, expected %v", tt.name, err, tt.error)
+		}
+	}
+}
+
+func TestSplitQuoted(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected []string
+	}{
+		{"a,b", []string{"a", "b"}},
+		{`"a,b",c`, []string{`"a,b"`, "c"}},
+		{`'a,b',c`, []string{`'a,b'`, "c"}},
+		{`"a\",b",c`, []string{`"a\",b"`, "c"}},
+		{`'a\',b`, []string{`'a\'`, "b"}},
+		{"", []string{""}},
+	}
+
+	for _, tt := range tests {
+		if got := splitQuoted(tt.s); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("splitQuoted(%q) = %q, expected %q", tt.s, got, tt.expected)
+		}
+	}
+}
+
+func TestStripComment(t *testing.T) {
+	tests := []struct {
+		line     string
+		expected string
+	}{
+		{"a # b", "a "},
+		{"# b", ""},
+		{"a#b", "a#b"},
+		{`"a # b" # c`, `"a # b" `},
+		{`'a # b' # c`, `'a # b' `},
+		{`"a \" # b" # c`, `"a \" # b" `},
+		{"a\t# b", "a\t"},
+	}
+
+	for _, tt := range tests {
+		if got := stripComment(tt.line); got != tt.expected {
+			t.Errorf("stripComment(%q) = %q, expected %q", tt.line, got, tt.expected)
+		}
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected string
+		fails    bool
+	}{
+		{"plain", "plain", false},
+		{`"with \"quotes\""`, `with "quotes"`, false},
+		{`"tab\t"`, "tab\t", false},
+		{`'C:\path'`, `C:\path`, false},
+		{`""`, "", false},
+		{`"`, "", true},
+		{`'`, "", true},
+		{`"open`, "", true},
+		{`'open`, "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := unquote(tt.s)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("unquote(%q) should fail", tt.s)
+			}
+			continue
+		}
+
+		if (err != nil) || (got != tt.expected) {
+			t.Errorf("unquote(%q) = %q, %v, expected %q", tt.s, got, err, tt.expected)
+		}
+	}
+}
+
+func TestConfigErrorsExitCode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfig := func(name, data string) string {
+		configPath := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(configPath, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return configPath
+	}
+
+	readAndApply := func(configPath string) error {
+		values, err := readConfigFile(configPath)
+		if err != nil {
+			return err
+		}
+
+		for _, v := range values {
+			if err := applyConfigValue(configPath, v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"unknown key", func() error { return readAndApply(writeConfig("unknown.yaml", "bogus: 1\n")) }},
+		{"invalid value", func() error { return readAndApply(writeConfig("invalid.toml", "jobs = \"many\"\n")) }},
+		{"list for scalar", func() error { return readAndApply(writeConfig("list.json", `{"jobs": [1, 2]}`)) }},
+		{"nested config", func() error { return readAndApply(writeConfig("nested.yaml", "config: other.yaml\n")) }},
+		{"yaml syntax", func() error { return readAndApply(writeConfig("syntax.yaml", "- a\n")) }},
+		{"toml table", func() error { return readAndApply(writeConfig("table.toml", "[install]\n")) }},
+		{"json syntax", func() error { return readAndApply(writeConfig("syntax.json", "{")) }},
+		{"unsupported format", func() error { return readAndApply(writeConfig("settings.ini", "jobs=1\n")) }},
+		{"missing file", func() error { return readAndApply(filepath.Join(dir, "missing.yaml")) }},
+		{"environment", func() error {
+			os.Setenv(envName("jobs"), "abc")
+			defer os.Unsetenv(envName("jobs"))
+			return applyEnvironment()
+		}},
+	}
+
+	for _, tt := range tests {
+		err := tt.run()
+		if err == nil {
+			t.Errorf("%v: expected an error", tt.name)
+			continue
+		}
+
+		if code := exitCode(err); code != exitCodeBadArguments {
+			t.Errorf("%v: exit code %v, expected %v (%v)", tt.name, code, exitCodeBadArguments, err)
+		}
+	}
+}
+
+func TestSplitList(t *testing.T) {
+	value := strings.Join([]string{`a{1,3}\.log`, "", "--name=first, second"}, envListSeparator)
+	expected := []string{`a{1,3}\.log`, "--name=first, second"}
+
+	if got := splitList(value); !reflect.DeepEqual(got, expected) {
+		t.Errorf("splitList(%q) = %q, expected %q", value, got, expected)
+	}
+}
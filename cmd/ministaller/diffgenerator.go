@@ -4,7 +4,6 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
 	"sync"
 )
 
@@ -31,10 +30,14 @@ type DiffGenerator struct {
 	installDirHashes   map[string]string
 	packageDirHashes   map[string]string
 	installDirPath     string
-	packageDirPath     string
-	exclude            []*regexp.Regexp
+	pkg                Package
+	filters            *PathFilter
+	components         *ComponentSet
 	keepMissing        bool
+	freshInstall       bool // install dir is empty so everything is added
 	forceUpdate        bool
+	progressReporter   *ProgressReporter
+	jobs               Limiter
 }
 
 func (df DiffGenerator) FilesToAdd() []*UpdateFileInfo {
@@ -52,7 +55,7 @@ func (df DiffGenerator) FilesToRemove() []*UpdateFileInfo {
 func (df *DiffGenerator) GenerateDiffs() error {
 	err := df.calculateHashes()
 	if err != nil {
-		log.Panic(err)
+		return &DiffError{Err: err}
 	}
 
 	var wg sync.WaitGroup
@@ -63,7 +66,7 @@ func (df *DiffGenerator) GenerateDiffs() error {
 			df.filesToAdd = append(df.filesToAdd, fi)
 		}
 
-		log.Printf("Found files to add. count=%v", len(df.filesToAdd))
+		logFields(LevelInfo, "Found files to add", "count", len(df.filesToAdd))
 		wg.Done()
 	}()
 
@@ -73,7 +76,7 @@ func (df *DiffGenerator) GenerateDiffs() error {
 			df.filesToRemove = append(df.filesToRemove, fi)
 		}
 
-		log.Printf("Found files to remove. count=%v", len(df.filesToRemove))
+		logFields(LevelInfo, "Found files to remove", "count", len(df.filesToRemove))
 		wg.Done()
 	}()
 
@@ -83,31 +86,69 @@ func (df *DiffGenerator) GenerateDiffs() error {
 			df.filesToUpdate = append(df.filesToUpdate, fi)
 		}
 
-		log.Printf("Found files to update. count=%v", len(df.filesToUpdate))
+		logFields(LevelInfo, "Found files to update", "count", len(df.filesToUpdate))
 		wg.Done()
 	}()
 
-	df.generateDirectoryDiff(df.installDirPath, df.packageDirPath)
+	df.generateDirectoryDiff(df.installDirPath, df.pkg)
 
 	wg.Wait()
+
+	select {
+	case err = <-df.errors:
+		return &DiffError{Err: err}
+	default:
+	}
+
 	log.Println("Differences generated")
 
-	return err
+	return nil
+}
+
+// fail remembers the first error of concurrent diff workers
+func (df *DiffGenerator) fail(err error) {
+	select {
+	case df.errors <- err:
+	default:
+	}
 }
 
 func (df *DiffGenerator) calculateHashes() error {
 	log.Println("Calculating hashes...")
 	var wg sync.WaitGroup
 
+	if df.freshInstall {
+		log.Println("Fresh install. Hashing only the package")
+		df.progressReporter.startPhase(PhaseDiff, df.pkg.TotalSize())
+		df.progressReporter.sendSystemMessage("Calculating hashes...")
+		df.packageDirHashes = df.pkg.Hashes(&ProgressWriter{df.progressReporter}, df.jobs)
+		return nil
+	}
+
+	total := calculateTotalSize(df.installDirPath) + df.pkg.TotalSize()
+	df.progressReporter.startPhase(PhaseDiff, total)
+	df.progressReporter.sendSystemMessage("Calculating hashes...")
+	progress := &ProgressWriter{df.progressReporter}
+
+	// parallel reading of two directories on the same
+	// spinning disk is slower than sequential reading
+	if onSameSpinningDisk(df.installDirPath, df.pkg.Location()) {
+		log.Println("Install and package dirs are on the same rotational disk. Hashing sequentially")
+		df.installDirHashes = CalculateHashes(df.installDirPath, progress, df.jobs)
+		df.packageDirHashes = df.pkg.Hashes(progress, df.jobs)
+		log.Println("Hashes calculated")
+		return nil
+	}
+
 	wg.Add(1)
 	go func() {
-		df.installDirHashes = CalculateHashes(df.installDirPath)
+		df.installDirHashes = CalculateHashes(df.installDirPath, progress, df.jobs)
 		wg.Done()
 	}()
 
 	wg.Add(1)
 	go func() {
-		df.packageDirHashes = CalculateHashes(df.packageDirPath)
+		df.packageDirHashes = df.pkg.Hashes(progress, df.jobs)
 		wg.Done()
 	}()
 
@@ -117,27 +158,30 @@ func (df *DiffGenerator) calculateHashes() error {
 	return nil
 }
 
-func (df *DiffGenerator) Excludes(path string) bool {
-	anyMatch := false
-
-	for _, f := range df.exclude {
-		if f.MatchString(path) {
-			anyMatch = true
-			break
-		}
+func (df *DiffGenerator) Excludes(op int, path string) bool {
+	if df.filters.Skips(op, path) {
+		logFields(LevelInfo, "Excluded by filters", "path", path)
+		installReport.recordSkipped(filterOpNames[op], path, skipExcluded)
+		return true
 	}
 
-	return anyMatch
+	return false
 }
 
-func (df *DiffGenerator) generateDirectoryDiff(installDir, packageDir string) {
-	log.Printf("Looking for changes. install_dir=%v package_dir=%v", installDir, packageDir)
+func (df *DiffGenerator) generateDirectoryDiff(installDir string, pkg Package) {
+	logFields(LevelInfo, "Looking for changes", "install_dir", installDir, "package", pkg.Location())
 
-	go df.findFilesToRemoveOrUpdate(installDir, packageDir)
-	go df.findFilesToAdd(installDir, packageDir)
+	if df.freshInstall {
+		close(df.filesToRemoveQueue)
+		close(df.filesToUpdateQueue)
+	} else {
+		go df.findFilesToRemoveOrUpdate(installDir, pkg)
+	}
+
+	go df.findFilesToAdd(installDir, pkg)
 }
 
-func (df *DiffGenerator) findFilesToRemoveOrUpdate(installDir, packageDir string) {
+func (df *DiffGenerator) findFilesToRemoveOrUpdate(installDir string, pkg Package) {
 	var wg sync.WaitGroup
 
 	err := filepath.Walk(installDir, func(path string, info os.FileInfo, err error) error {
@@ -145,21 +189,27 @@ func (df *DiffGenerator) findFilesToRemoveOrUpdate(installDir, packageDir string
 			return err
 		}
 
+		if info.IsDir() && isDataDir(installDir, path) {
+			return filepath.SkipDir
+		}
+
 		if !info.Mode().IsRegular() {
 			return nil
 		}
 
 		wg.Add(1)
+		df.jobs.Acquire()
 
 		go func() {
 			defer wg.Done()
+			defer df.jobs.Release()
 
 			relativePath, err := filepath.Rel(df.installDirPath, path)
 			if err != nil {
-				log.Panic(err)
+				df.fail(err)
+				return
 			}
 			relativePath = filepath.ToSlash(relativePath)
-			packagePath := filepath.Join(df.packageDirPath, relativePath)
 			installFileHash := df.installDirHashes[relativePath]
 
 			ufi := &UpdateFileInfo{
@@ -167,15 +217,18 @@ func (df *DiffGenerator) findFilesToRemoveOrUpdate(installDir, packageDir string
 				Sha1:     installFileHash,
 			}
 
-			// path does not exist in our package
-			if pfi, err := os.Stat(packagePath); os.IsNotExist(err) {
-				if df.Excludes(relativePath) {
-					log.Printf("Excluded by filters. path=%v", relativePath)
+			pfi, ok := pkg.Files()[relativePath]
+			deselected := ok && !df.components.Includes(relativePath)
+
+			// path does not exist in our package or its component is not selected
+			if !ok || deselected {
+				if df.Excludes(FilterRemove, relativePath) {
 					return
 				}
 
-				if df.keepMissing {
-					log.Printf("Keeping missing file. path=%v", relativePath)
+				if df.keepMissing && !deselected {
+					logFields(LevelInfo, "Keeping missing file", "path", relativePath)
+					installReport.recordSkipped(opRemove, relativePath, skipKeptMissing)
 					return
 				}
 
@@ -186,7 +239,11 @@ func (df *DiffGenerator) findFilesToRemoveOrUpdate(installDir, packageDir string
 				packageFileHash := df.packageDirHashes[relativePath]
 
 				if (packageFileHash != installFileHash) || (df.forceUpdate) {
-					ufi.FileSize = pfi.Size()
+					if df.Excludes(FilterUpdate, relativePath) {
+						return
+					}
+
+					ufi.FileSize = pfi.FileSize
 					df.filesToUpdateQueue <- ufi
 				}
 			}
@@ -196,7 +253,8 @@ func (df *DiffGenerator) findFilesToRemoveOrUpdate(installDir, packageDir string
 	})
 
 	if err != nil {
-		log.Printf("Failed to update/remove generation. err=%v", err)
+		logFields(LevelError, "Failed to update/remove generation", "error", err)
+		df.fail(err)
 	}
 
 	wg.Wait()
@@ -204,48 +262,60 @@ func (df *DiffGenerator) findFilesToRemoveOrUpdate(installDir, packageDir string
 	close(df.filesToUpdateQueue)
 }
 
-func (df *DiffGenerator) findFilesToAdd(installDir, packageDir string) {
+func (df *DiffGenerator) findFilesToAdd(installDir string, pkg Package) {
 	var wg sync.WaitGroup
-	err := filepath.Walk(packageDir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
 
-		if !info.Mode().IsRegular() {
-			return nil
+	for relativePath, pfi := range pkg.Files() {
+		if !df.components.Includes(relativePath) {
+			installReport.recordSkipped(opAdd, relativePath, skipNotSelected)
+			continue
 		}
 
 		wg.Add(1)
+		df.jobs.Acquire()
 
-		go func() {
+		go func(relativePath string, filesize int64) {
 			defer wg.Done()
+			defer df.jobs.Release()
 
-			relativePath, err := filepath.Rel(df.packageDirPath, path)
-			if err != nil {
-				log.Panic(err)
-			}
-			relativePath = filepath.ToSlash(relativePath)
-			installPath := filepath.Join(df.installDirPath, relativePath)
+			installPath := filepath.Join(installDir, relativePath)
 
 			if _, err := os.Stat(installPath); os.IsNotExist(err) {
+				if df.Excludes(FilterAdd, relativePath) {
+					return
+				}
+
 				packageFileHash := df.packageDirHashes[relativePath]
-				efi, _ := os.Stat(path)
 
 				df.filesToAddQueue <- &UpdateFileInfo{
 					Filepath: relativePath,
 					Sha1:     packageFileHash,
-					FileSize: efi.Size(),
+					FileSize: filesize,
 				}
 			}
-		}()
+		}(relativePath, pfi.FileSize)
+	}
 
-		return nil
-	})
+	wg.Wait()
+	close(df.filesToAddQueue)
+}
 
+// isDataDir checks if path is ministaller's own dir in the root
+func isDataDir(root, fullpath string) bool {
+	relativePath, err := filepath.Rel(root, fullpath)
+	return (err == nil) && (filepath.ToSlash(relativePath) == DataDirName)
+}
+
+func onSameSpinningDisk(first, second string) bool {
+	firstDisk, rotational, err := blockDeviceInfo(first)
+	if (err != nil) || !rotational {
+		return false
+	}
+
+	secondDisk, _, err := blockDeviceInfo(second)
 	if err != nil {
-		log.Printf("Failed to generate add patch. err=%v", err)
+		return false
 	}
 
-	wg.Wait()
-	close(df.filesToAddQueue)
+	return firstDisk == secondDisk
 }
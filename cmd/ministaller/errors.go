@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// exit codes are a part of the command line interface
+// and should never be renumbered
+const (
+	exitCodeSuccess            = 0 // command succeeded
+	exitCodeFailure            = 1 // failed before anything was changed
+	exitCodeBadArguments       = 2 // invalid flags, config or components
+	exitCodeDownloadFailed     = 3 // package or manifest could not be downloaded
+	exitCodeRolledBack         = 4 // install failed and all changes were reverted
+	exitCodeRollbackFailed     = 5 // install failed and some changes could not be reverted
+	exitCodeVerificationFailed = 6 // package hash or signature does not match
+	exitCodeLockBusy           = 7 // another ministaller works with install dir
+)
+
+var exitCodeDescriptions = []struct {
+	code        int
+	description string
+}{
+	{exitCodeSuccess, "success"},
+	{exitCodeFailure, "failed before anything was changed"},
+	{exitCodeBadArguments, "invalid arguments, config or components"},
+	{exitCodeDownloadFailed, "download failed"},
+	{exitCodeRolledBack, "install failed and was rolled back"},
+	{exitCodeRollbackFailed, "install failed and rollback failed"},
+	{exitCodeVerificationFailed, "package verification failed"},
+	{exitCodeLockBusy, "install dir is locked by another ministaller"},
+}
+
+// ArgumentError is returned for invalid flags, config values or components
+type ArgumentError struct {
+	msg string
+}
+
+func (ae *ArgumentError) Error() string {
+	return ae.msg
+}
+
+// DownloadError is returned when the package or its manifest cannot be downloaded
+type DownloadError struct {
+	URL string
+	Err error
+}
+
+func (de *DownloadError) Error() string {
+	return fmt.Sprintf("failed to download %v: %v", de.URL, de.Err)
+}
+
+func (de *DownloadError) Unwrap() error {
+	return de.Err
+}
+
+// VerificationError is returned when the package does not match
+// the expected hash or signature
+type VerificationError struct {
+	Err error
+}
+
+func (ve *VerificationError) Error() string {
+	return fmt.Sprintf("verification failed: %v", ve.Err)
+}
+
+func (ve *VerificationError) Unwrap() error {
+	return ve.Err
+}
+
+// DiffError is returned by DiffGenerator when install dir
+// cannot be compared with the package
+type DiffError struct {
+	Err error
+}
+
+func (de *DiffError) Error() string {
+	return fmt.Sprintf("failed to find differences: %v", de.Err)
+}
+
+func (de *DiffError) Unwrap() error {
+	return de.Err
+}
+
+// RolledBackError is returned by installers when install failed
+// and install dir was returned to the previous state
+type RolledBackError struct {
+	Err error
+}
+
+func (rbe *RolledBackError) Error() string {
+	return fmt.Sprintf("install rolled back: %v", rbe.Err)
+}
+
+func (rbe *RolledBackError) Unwrap() error {
+	return rbe.Err
+}
+
+// RollbackError is returned by installers when install failed
+// and install dir could not be returned to the previous state
+type RollbackError struct {
+	Err   error
+	Files []string // files that could not be restored
+}
+
+func (re *RollbackError) Error() string {
+	if len(re.Files) == 0 {
+		return fmt.Sprintf("rollback incomplete: %v", re.Err)
+	}
+
+	return fmt.Sprintf("rollback incomplete (%v files not restored): %v", len(re.Files), re.Err)
+}
+
+func (re *RollbackError) Unwrap() error {
+	return re.Err
+}
+
+// rolledBack wraps install error unless it already tells
+// how rollback ended
+func rolledBack(err error) error {
+	var rbe *RolledBackError
+	var re *RollbackError
+	if errors.As(err, &rbe) || errors.As(err, &re) {
+		return err
+	}
+
+	return &RolledBackError{Err: err}
+}
+
+// rollbackResult wraps install error depending on
+// whether all files were restored
+func rollbackResult(err error, failed []string) error {
+	if len(failed) > 0 {
+		return &RollbackError{Err: err, Files: failed}
+	}
+
+	return rolledBack(err)
+}
+
+// exitCode maps errors to exit codes; the most severe one wins
+// if the error wraps several typed errors
+func exitCode(err error) int {
+	var (
+		rollbackErr     *RollbackError
+		verificationErr *VerificationError
+		rolledBackErr   *RolledBackError
+		downloadErr     *DownloadError
+		argumentErr     *ArgumentError
+		lockErr         *LockBusyError
+	)
+
+	switch {
+	case err == nil:
+		return exitCodeSuccess
+	case errors.As(err, &rollbackErr):
+		return exitCodeRollbackFailed
+	case errors.As(err, &verificationErr):
+		return exitCodeVerificationFailed
+	case errors.As(err, &rolledBackErr):
+		return exitCodeRolledBack
+	case errors.As(err, &downloadErr):
+		return exitCodeDownloadFailed
+	case errors.As(err, &argumentErr):
+		return exitCodeBadArguments
+	case errors.As(err, &lockErr):
+		return exitCodeLockBusy
+	}
+
+	return exitCodeFailure
+}
+
+func printExitCodes(w io.Writer) {
+	fmt.Fprintln(w, "Exit codes:")
+	for _, ec := range exitCodeDescriptions {
+		fmt.Fprintf(w, "  %v\t%v\n", ec.code, ec.description)
+	}
+}
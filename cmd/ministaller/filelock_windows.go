@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+var (
+	lockFileExProc   = kernel.MustFindProc("LockFileEx")
+	unlockFileExProc = kernel.MustFindProc("UnlockFileEx")
+)
+
+// lock region is placed beyond the content so that
+// other processes can still read the owner info
+func lockRegion() *syscall.Overlapped {
+	return &syscall.Overlapped{OffsetHigh: 1}
+}
+
+func lockFile(f *os.File) error {
+	ret, _, err := lockFileExProc.Call(
+		f.Fd(),
+		lockfileExclusiveLock|lockfileFailImmediately,
+		0,
+		1,
+		0,
+		uintptr(unsafe.Pointer(lockRegion())))
+	if ret != 0 {
+		return nil
+	}
+
+	if err == errorLockViolation {
+		return errLockBusy
+	}
+
+	return err
+}
+
+func unlockFile(f *os.File) error {
+	ret, _, err := unlockFileExProc.Call(
+		f.Fd(),
+		0,
+		1,
+		0,
+		uintptr(unsafe.Pointer(lockRegion())))
+	if ret == 0 {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// operations filters can be applied to
+const (
+	FilterAdd = 1 << iota
+	FilterUpdate
+	FilterRemove
+)
+
+const (
+	syntaxGlob   = "glob"
+	syntaxRegexp = "regexp"
+)
+
+type filterRule struct {
+	pattern string
+	re      *regexp.Regexp
+	negate  bool
+}
+
+// PathFilter decides which relative paths are skipped by the diff
+// using gitignore-like rules where the last matching rule wins
+type PathFilter struct {
+	includes []*filterRule
+	excludes []*filterRule
+	ops      int
+}
+
+func NewPathFilter(syntax string, includes, excludes []string, ops int) (*PathFilter, error) {
+	pf := &PathFilter{ops: ops}
+
+	for _, p := range includes {
+		r, err := compileRule(syntax, p)
+		if err != nil {
+			return nil, err
+		}
+		pf.includes = append(pf.includes, r)
+	}
+
+	for _, p := range excludes {
+		r, err := compileRule(syntax, p)
+		if err != nil {
+			return nil, err
+		}
+		pf.excludes = append(pf.excludes, r)
+	}
+
+	return pf, nil
+}
+
+// ParseFilterOps parses comma-separated list of operations (add,update,remove)
+func ParseFilterOps(s string) (int, error) {
+	ops := 0
+
+	for _, op := range strings.Split(s, ",") {
+		switch strings.TrimSpace(op) {
+		case "add":
+			ops |= FilterAdd
+		case "update":
+			ops |= FilterUpdate
+		case "remove":
+			ops |= FilterRemove
+		case "all":
+			ops |= FilterAdd | FilterUpdate | FilterRemove
+		case "":
+		default:
+			return 0, fmt.Errorf("unknown filter operation: %v", op)
+		}
+	}
+
+	return ops, nil
+}
+
+// LoadFile appends exclude rules from gitignore-like file
+func (pf *PathFilter) LoadFile(filepath string) error {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return pf.Load(filepath, f)
+}
+
+// Load appends exclude rules in gitignore-like format
+// (one glob pattern per line, # for comments, ! to negate)
+func (pf *PathFilter) Load(filepath string, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	count := 0
+
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(scanner.Text())
+
+		if (len(line) == 0) || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		r, err := compileRule(syntaxGlob, line)
+		if err != nil {
+			return fmt.Errorf("%v:%v: %v", filepath, lineNumber, err)
+		}
+
+		pf.excludes = append(pf.excludes, r)
+		count++
+	}
+
+	logFields(LevelInfo, "Loaded filters file", "path", filepath, "patterns", count)
+
+	return scanner.Err()
+}
+
+// Skips returns true if path should not be touched by the operation
+func (pf *PathFilter) Skips(op int, relpath string) bool {
+	if (pf == nil) || (pf.ops&op == 0) {
+		return false
+	}
+
+	if (len(pf.includes) > 0) && !matchRules(pf.includes, relpath) {
+		return true
+	}
+
+	return matchRules(pf.excludes, relpath)
+}
+
+func (pf *PathFilter) String() string {
+	if pf == nil {
+		return "[]"
+	}
+
+	patterns := make([]string, 0, len(pf.includes)+len(pf.excludes))
+	for _, r := range pf.includes {
+		patterns = append(patterns, "+"+r.pattern)
+	}
+	for _, r := range pf.excludes {
+		patterns = append(patterns, "-"+r.pattern)
+	}
+
+	return "[" + strings.Join(patterns, " ") + "]"
+}
+
+func matchRules(rules []*filterRule, relpath string) bool {
+	matched := false
+
+	for _, r := range rules {
+		if r.re.MatchString(relpath) {
+			matched = !r.negate
+		}
+	}
+
+	return matched
+}
+
+func compileRule(syntax, pattern string) (*filterRule, error) {
+	if syntax == syntaxRegexp {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		return &filterRule{pattern: pattern, re: re}, nil
+	}
+
+	r := &filterRule{pattern: pattern}
+
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	}
+
+	expr, err := globToRegexp(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", r.pattern, err)
+	}
+
+	r.re, err = regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", r.pattern, err)
+	}
+
+	return r, nil
+}
+
+// globToRegexp converts gitignore-style glob to regular expression
+// that matches the path itself or any path inside of it
+func globToRegexp(pattern string) (string, error) {
+	dirOnly := strings.HasSuffix(pattern, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+
+	if len(pattern) == 0 {
+		return "", errors.New("empty pattern")
+	}
+
+	var sb strings.Builder
+
+	// patterns without slashes match at any depth
+	if strings.HasPrefix(pattern, "/") || strings.Contains(pattern, "/") {
+		sb.WriteString("^")
+		pattern = strings.TrimPrefix(pattern, "/")
+	} else {
+		sb.WriteString("^(?:.*/)?")
+	}
+
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+
+		switch c {
+		case '*':
+			if strings.HasPrefix(pattern[i:], "**") {
+				atStart := (i == 0) || (pattern[i-1] == '/')
+				rest := pattern[i+2:]
+
+				if atStart && strings.HasPrefix(rest, "/") {
+					// "**/" matches zero or more directories
+					sb.WriteString("(?:.*/)?")
+					i += 2
+				} else if atStart && (len(rest) == 0) {
+					sb.WriteString(".*")
+					i++
+				} else {
+					sb.WriteString("[^/]*")
+					i++
+				}
+			} else {
+				sb.WriteString("[^/]*")
+			}
+		case '?':
+			sb.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end == -1 {
+				return "", errors.New("unterminated character class")
+			}
+
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+
+			sb.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				sb.WriteString(regexp.QuoteMeta(string(pattern[i])))
+			}
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	if dirOnly {
+		sb.WriteString("/.*$")
+	} else {
+		sb.WriteString("(?:/.*)?$")
+	}
+
+	return sb.String(), nil
+}
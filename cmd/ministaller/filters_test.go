@@ -0,0 +1,100 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		matches []string
+		skips   []string
+	}{
+		{"*.log", []string{"a.log", "dir/a.log", "a.log/inner"}, []string{"a.logx", "log"}},
+		{"/build", []string{"build", "build/out.bin"}, []string{"src/build", "builds"}},
+		{"docs/*.md", []string{"docs/a.md"}, []string{"x/docs/a.md", "docs/sub/a.md"}},
+		{"**/cache", []string{"cache", "a/b/cache", "a/cache/file"}, []string{"cached", "a/mycache"}},
+		{"logs/**", []string{"logs/a", "logs/a/b"}, []string{"logs", "old/logs/a"}},
+		{"a/**/b", []string{"a/b", "a/x/y/b", "a/x/b/file"}, []string{"b", "x/a/b", "a/xb"}},
+		{"tmp/", []string{"tmp/x", "a/tmp/x"}, []string{"tmp", "a/tmp"}},
+		{"file?.txt", []string{"file1.txt"}, []string{"file10.txt", "file/.txt"}},
+		{"[abc].txt", []string{"a.txt", "dir/c.txt"}, []string{"d.txt"}},
+		{"[!abc].txt", []string{"d.txt"}, []string{"a.txt"}},
+		{`\*.txt`, []string{"*.txt"}, []string{"a.txt"}},
+	}
+
+	for _, tt := range tests {
+		expr, err := globToRegexp(tt.pattern)
+		if err != nil {
+			t.Errorf("globToRegexp(%q) failed: %v", tt.pattern, err)
+			continue
+		}
+
+		re := regexp.MustCompile(expr)
+
+		for _, p := range tt.matches {
+			if !re.MatchString(p) {
+				t.Errorf("pattern %q (%v) should match %q", tt.pattern, expr, p)
+			}
+		}
+
+		for _, p := range tt.skips {
+			if re.MatchString(p) {
+				t.Errorf("pattern %q (%v) should not match %q", tt.pattern, expr, p)
+			}
+		}
+	}
+}
+
+func TestGlobToRegexpErrors(t *testing.T) {
+	for _, pattern := range []string{"", "/", "[abc"} {
+		if _, err := globToRegexp(pattern); err == nil {
+			t.Errorf("globToRegexp(%q) should fail", pattern)
+		}
+	}
+}
+
+func TestPathFilterNegation(t *testing.T) {
+	pf, err := NewPathFilter(syntaxGlob, nil, []string{"*.log", "!keep.log", "logs/"}, FilterRemove)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path  string
+		skips bool
+	}{
+		{"a.log", true},
+		{"dir/a.log", true},
+		{"keep.log", false},
+		{"dir/keep.log", false},
+		{"logs/keep.log", true},
+		{"a.txt", false},
+	}
+
+	for _, tt := range tests {
+		if got := pf.Skips(FilterRemove, tt.path); got != tt.skips {
+			t.Errorf("Skips(%q) = %v, expected %v", tt.path, got, tt.skips)
+		}
+	}
+
+	if pf.Skips(FilterAdd, "a.log") {
+		t.Error("filter should not apply to other operations")
+	}
+}
+
+func TestPathFilterRegexp(t *testing.T) {
+	pf, err := NewPathFilter(syntaxRegexp, nil, []string{`^data/.*\.db$`}, FilterRemove)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !pf.Skips(FilterRemove, "data/app.db") {
+		t.Error("regexp pattern should match data/app.db")
+	}
+
+	if pf.Skips(FilterRemove, "data/app.dbx") {
+		t.Error("regexp pattern should not match data/app.dbx")
+	}
+}
@@ -4,6 +4,7 @@ package main
 
 import (
 	"log"
+	"os"
 )
 
 var (
@@ -11,7 +12,16 @@ var (
 )
 
 func NewUIProgressHandler() ProgressHandler {
-	return &UIProgressHandler{}
+	// log lines on stdout would garble the progress bar
+	if *stdoutFlag {
+		return &UIProgressHandler{}
+	}
+
+	if isTerminal(os.Stdout) {
+		return NewTTYProgressHandler(os.Stdout)
+	}
+
+	return NewPlainProgressHandler(os.Stdout)
 }
 
 type UIProgressHandler struct {
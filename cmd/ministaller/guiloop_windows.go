@@ -27,6 +27,22 @@ func (ph *WinUIProgressHandler) HandleSystemMessage(msg string) {
 	lb.SetCaption(msg)
 }
 
+func (ph *WinUIProgressHandler) HandlePhaseChange(phase string) {
+	// label shows system messages instead
+}
+
+func (ph *WinUIProgressHandler) HandleProgress(current, total uint64) {
+	// progress bar is updated on percent change
+}
+
+func (ph *WinUIProgressHandler) HandleFileChange(relpath string) {
+	// label shows only current stage
+}
+
+func (ph *WinUIProgressHandler) HandleConfirmation(question string) bool {
+	return gform.MsgBox(mw, "ministaller", question, w32.MB_YESNO|w32.MB_ICONQUESTION) == w32.IDYES
+}
+
 func (ph *WinUIProgressHandler) HandleFinish() {
 	guifinish()
 }
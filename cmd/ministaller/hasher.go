@@ -4,6 +4,7 @@ import (
 	"crypto/sha1"
 	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
@@ -16,11 +17,11 @@ type HashResult struct {
 	err  error
 }
 
-func CalculateHashes(root string) map[string]string {
+func CalculateHashes(root string, progress io.Writer, jobs Limiter) map[string]string {
 	var wg sync.WaitGroup
 	c := make(chan HashResult)
 
-	go calculateSha1Hashes(root, &wg, c)
+	go calculateSha1Hashes(root, &wg, c, progress, jobs)
 
 	m := make(map[string]string)
 
@@ -28,13 +29,13 @@ func CalculateHashes(root string) map[string]string {
 		wg.Done()
 
 		if r.err != nil {
-			log.Printf("Error while calculating hash: %v", r.err)
+			logError("Error while calculating hash: %v", r.err)
 			continue
 		}
 
 		key, err := filepath.Rel(root, r.path)
 		if err != nil {
-			log.Printf("Error while calculating relative path: %v", err)
+			logError("Error while calculating relative path: %v", err)
 		} else {
 			key = filepath.ToSlash(key)
 			m[key] = r.hash
@@ -46,20 +47,26 @@ func CalculateHashes(root string) map[string]string {
 	return m
 }
 
-func calculateSha1Hashes(root string, wg *sync.WaitGroup, c chan HashResult) {
+func calculateSha1Hashes(root string, wg *sync.WaitGroup, c chan HashResult, progress io.Writer, jobs Limiter) {
 	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
+		if info.IsDir() && isDataDir(root, path) {
+			return filepath.SkipDir
+		}
+
 		if !info.Mode().IsRegular() {
 			return nil
 		}
 
 		wg.Add(1)
+		jobs.Acquire()
 
 		go func() {
-			hash, err := calculateFileHash(path)
+			hash, err := calculateFileHashWithProgress(path, progress)
+			jobs.Release()
 			c <- HashResult{path, hash, err}
 		}()
 
@@ -67,7 +74,7 @@ func calculateSha1Hashes(root string, wg *sync.WaitGroup, c chan HashResult) {
 	})
 
 	if err != nil {
-		log.Printf("Error while hashing: %v", err)
+		logError("Error while hashing: %v", err)
 	}
 
 	wg.Wait()
@@ -76,7 +83,34 @@ func calculateSha1Hashes(root string, wg *sync.WaitGroup, c chan HashResult) {
 	log.Println("Hashing generation finished")
 }
 
+// calculateTotalSize returns size of all regular files in the root
+func calculateTotalSize(root string) uint64 {
+	var total uint64
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && isDataDir(root, path) {
+			return filepath.SkipDir
+		}
+
+		if info.Mode().IsRegular() {
+			total += uint64(info.Size())
+		}
+
+		return nil
+	})
+
+	return total
+}
+
 func calculateFileHash(filepath string) (string, error) {
+	return calculateFileHashWithProgress(filepath, ioutil.Discard)
+}
+
+func calculateFileHashWithProgress(filepath string, progress io.Writer) (string, error) {
 	f, err := os.Open(filepath)
 	if err != nil {
 		return "", err
@@ -84,9 +118,13 @@ func calculateFileHash(filepath string) (string, error) {
 
 	defer f.Close()
 
+	return calculateReaderHash(io.TeeReader(f, progress))
+}
+
+func calculateReaderHash(r io.Reader) (string, error) {
 	hasher := sha1.New()
 
-	if _, err := io.Copy(hasher, f); err != nil {
+	if _, err := io.Copy(hasher, r); err != nil {
 		return "", err
 	}
 
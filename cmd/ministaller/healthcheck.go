@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+const (
+	healthPollInterval   = 500 * time.Millisecond
+	healthRequestTimeout = 5 * time.Second
+)
+
+// HealthCheck makes sure installed application works before
+// the install is committed: exe must exit with 0 (or keep running
+// for alive duration) and url must respond with 200
+type HealthCheck struct {
+	exe              string        // relative to install dir
+	alive            time.Duration // exe should keep running instead of exiting
+	url              string
+	timeout          time.Duration
+	progressReporter *ProgressReporter
+}
+
+func (hc *HealthCheck) Run(installDir string) error {
+	logFields(LevelInfo, "Running health check", "exe", hc.exe, "alive", hc.alive, "url", hc.url, "timeout", hc.timeout)
+	hc.progressReporter.sendSystemMessage("Checking the installation...")
+
+	started := time.Now()
+	var exited chan error
+
+	if len(hc.exe) > 0 {
+		cmd, err := hc.start(installDir)
+		if err != nil {
+			return fmt.Errorf("health check failed: %v", err)
+		}
+
+		exited = make(chan error, 1)
+		go func() {
+			exited <- cmd.Wait()
+		}()
+
+		defer func() {
+			if exited != nil {
+				logFields(LevelInfo, "Stopping health check process", "pid", cmd.Process.Pid)
+				killProcessGroup(cmd)
+				<-exited
+			}
+		}()
+
+		if hc.alive == 0 {
+			select {
+			case err := <-exited:
+				exited = nil
+				if err != nil {
+					return fmt.Errorf("health check failed: %v exited with %v", hc.exe, err)
+				}
+			case <-time.After(hc.timeout):
+				return fmt.Errorf("health check failed: %v did not exit in %v", hc.exe, hc.timeout)
+			}
+		}
+	}
+
+	if len(hc.url) > 0 {
+		if err := hc.waitURL(exited); err != nil {
+			return fmt.Errorf("health check failed: %v", err)
+		}
+	}
+
+	if (exited != nil) && (hc.alive > 0) {
+		select {
+		case err := <-exited:
+			exited = nil
+			return fmt.Errorf("health check failed: %v exited after %v: %v", hc.exe, time.Since(started).Round(time.Millisecond), err)
+		case <-time.After(time.Until(started.Add(hc.alive))):
+		}
+	}
+
+	logFields(LevelInfo, "Health check passed", "duration", time.Since(started))
+	return nil
+}
+
+func (hc *HealthCheck) start(installDir string) (*exec.Cmd, error) {
+	exePath := resolveCommandPath(installDir, hc.exe)
+
+	cmd := exec.Command(exePath)
+	cmd.Dir = filepath.FromSlash(installDir)
+	setProcessGroup(cmd)
+
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	logFields(LevelInfo, "Health check process started", "path", exePath, "pid", cmd.Process.Pid)
+	return cmd, nil
+}
+
+// waitURL polls url until it responds with 200 or the timeout
+// expires; exited reports if the checked process exits meanwhile
+func (hc *HealthCheck) waitURL(exited chan error) error {
+	client := &http.Client{Timeout: healthRequestTimeout}
+	deadline := time.Now().Add(hc.timeout)
+
+	for {
+		resp, err := client.Get(hc.url)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				logFields(LevelInfo, "Health check url responded", "addr", hc.url)
+				return nil
+			}
+			err = fmt.Errorf("unexpected response status: %v", resp.Status)
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%v did not respond with 200 in %v: %v", hc.url, hc.timeout, err)
+		}
+
+		select {
+		case werr := <-exited:
+			exited <- werr
+			return fmt.Errorf("%v exited before %v responded: %v", hc.exe, hc.url, werr)
+		case <-time.After(healthPollInterval):
+		}
+	}
+}
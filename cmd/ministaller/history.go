@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	HistoryFileName = "history.jsonl"
+)
+
+// HistoryEntry is one line of the append-only install history
+// in <install-path>/.ministaller/history.jsonl
+type HistoryEntry struct {
+	Time        time.Time `json:"time"`
+	Command     string    `json:"command"`
+	RunID       string    `json:"run_id"`
+	FromVersion string    `json:"from_version"`
+	ToVersion   string    `json:"to_version"`
+	Package     string    `json:"package"`
+	PackageHash string    `json:"package_hash"`
+	Result      string    `json:"result"`
+	Error       string    `json:"error,omitempty"`
+	Duration    float64   `json:"duration_seconds"`
+}
+
+func (r *InstallReport) historyEntry() *HistoryEntry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return &HistoryEntry{
+		Time:        r.Started,
+		Command:     r.Command,
+		RunID:       r.RunID,
+		FromVersion: r.FromVersion,
+		ToVersion:   r.ToVersion,
+		Package:     r.Package,
+		PackageHash: r.PackageHash,
+		Result:      r.Status,
+		Error:       r.Error,
+		Duration:    r.Finished.Sub(r.Started).Seconds(),
+	}
+}
+
+// AppendHistory adds the entry to the history file; existing
+// entries are never rewritten
+func AppendHistory(installDir string, entry *HistoryEntry) error {
+	historyDir := path.Join(installDir, DataDirName)
+	err := os.MkdirAll(historyDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	historyPath := path.Join(historyDir, HistoryFileName)
+	f, err := os.OpenFile(historyPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+
+	logFields(LevelInfo, "History entry added", "path", historyPath, "result", entry.Result)
+
+	return f.Sync()
+}
+
+// ReadHistory returns entries from the oldest to the newest skipping
+// lines that cannot be parsed (like one cut short by a crash)
+func ReadHistory(installDir string) ([]*HistoryEntry, error) {
+	f, err := os.Open(path.Join(installDir, DataDirName, HistoryFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	entries := make([]*HistoryEntry, 0)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		entry := &HistoryEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			logFields(LevelWarn, "Skipping malformed history entry", "line", line, "error", err)
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+func printHistory(w io.Writer, entries []*HistoryEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tCOMMAND\tFROM\tTO\tRESULT\tDURATION\tPACKAGE\tHASH")
+
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+			e.Time.Local().Format("2006-01-02 15:04:05"),
+			e.Command,
+			orDash(e.FromVersion),
+			orDash(e.ToVersion),
+			e.Result,
+			time.Duration(e.Duration*float64(time.Second)).Round(time.Millisecond),
+			orDash(e.Package),
+			orDash(e.PackageHash))
+	}
+
+	return tw.Flush()
+}
+
+func orDash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+
+	return s
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
@@ -10,6 +12,7 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
+	"time"
 )
 
 const (
@@ -17,6 +20,7 @@ const (
 	RenamePrice = CopyPrice
 
 	RemoveBackupPrice = 30
+	LinkPrice         = 30
 	RemoveFactor      = RenamePrice
 	UpdateFactor      = RenamePrice + CopyPrice
 	AddFactor         = CopyPrice
@@ -26,6 +30,11 @@ const (
 	BackupExt = ".bak"
 )
 
+const (
+	restoreAttempts   = 3
+	restoreRetryDelay = 200 * time.Millisecond
+)
+
 type BackupPair struct {
 	relpath string
 	newpath string
@@ -35,24 +44,8 @@ type CopyRequest struct {
 	from, to string
 }
 
-type ProgressHandler interface {
-	HandleSystemMessage(message string)
-	HandlePercentChange(percent int)
-	HandleFinish()
-}
-
-type LogProgressHandler struct {
-}
-
-type ProgressReporter struct {
-	grandTotal        uint64
-	currentProgress   uint64
-	progressChan      chan int64
-	progressWG        sync.WaitGroup
-	percent           int //0..100
-	systemMessageChan chan string
-	finished          chan bool
-	progressHandler   ProgressHandler
+type Installer interface {
+	Install(filesProvider UpdateFilesProvider) error
 }
 
 type PackageInstaller struct {
@@ -61,31 +54,55 @@ type PackageInstaller struct {
 	backupsWG        sync.WaitGroup
 	progressReporter *ProgressReporter
 	installDir       string
-	packageDir       string
-	removeSelfPath   string // if updating the installer
-	failInTheEnd     bool   // for debugging purposes
-}
-
-func (pi *PackageInstaller) Install(filesProvider UpdateFilesProvider) error {
+	pkg              Package
+	removeSelfPath   string    // if updating the installer
+	verifier         *Verifier // rehashes installed files if set
+	healthCheck      *HealthCheck
+	permissions      *PermissionSet
+	freshInstall     bool // permissions are applied to the whole tree
+	strictRemove     bool // fail if file cannot be removed
+	jobs             int  // concurrent file operations
+	failInTheEnd     bool // for debugging purposes
+}
+
+func (pi *PackageInstaller) Install(filesProvider UpdateFilesProvider) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			log.Printf("Recovered in install... %v", r)
-			pi.afterFailure(filesProvider)
+			logError("Recovered in install... %v", r)
+			failed := pi.afterFailure(filesProvider)
+			err = rollbackResult(fmt.Errorf("install panicked: %v", r), failed)
 		}
 	}()
 
-	pi.progressReporter.grandTotal = pi.calculateGrandTotals(filesProvider)
-
-	go pi.progressReporter.reportingLoop()
+	pi.progressReporter.startPhase(PhaseInstall, pi.calculateGrandTotals(filesProvider))
 
 	pi.beforeInstall()
 
-	err := pi.installPackage(filesProvider)
+	err = pi.installPackage(filesProvider)
+
+	if (err == nil) && (pi.verifier != nil) {
+		err = pi.verifier.Verify(pi.installDir, filesProvider)
+	}
+
+	// failed permissions are rolled back like any other install error
+	if err == nil {
+		err = pi.permissions.Apply(pi.installDir, changedFiles(filesProvider), pi.freshInstall)
+	}
+
+	if (err == nil) && pi.failInTheEnd {
+		err = errors.New("failing install on purpose")
+	}
+
+	// backups are removed only after the installed app is healthy
+	if (err == nil) && (pi.healthCheck != nil) {
+		err = pi.healthCheck.Run(pi.installDir)
+	}
 
-	if (err == nil) && (!pi.failInTheEnd) {
+	if err == nil {
 		pi.afterSuccess()
 	} else {
-		pi.afterFailure(filesProvider)
+		failed := pi.afterFailure(filesProvider)
+		err = rollbackResult(err, failed)
 	}
 
 	pi.teardown()
@@ -124,6 +141,9 @@ func (pi *PackageInstaller) installPackage(filesProvider UpdateFilesProvider) (e
 	go pi.accountBackups()
 
 	defer func() {
+		// rollback needs every backup accounted
+		log.Println("Waiting for backups to finish accounting...")
+		pi.backupsWG.Wait()
 		close(pi.backupsChan)
 	}()
 
@@ -145,9 +165,6 @@ func (pi *PackageInstaller) installPackage(filesProvider UpdateFilesProvider) (e
 		return err
 	}
 
-	log.Println("Waiting for backups to finish accounting...")
-	pi.backupsWG.Wait()
-
 	return nil
 }
 
@@ -167,13 +184,27 @@ func (pi *PackageInstaller) afterSuccess() {
 	cleanupEmptyDirs(pi.installDir)
 }
 
-func (pi *PackageInstaller) afterFailure(filesProvider UpdateFilesProvider) {
+// afterFailure rolls back the changes and returns relative paths
+// of the files that could not be returned to the previous state
+func (pi *PackageInstaller) afterFailure(filesProvider UpdateFilesProvider) []string {
 	log.Println("After failure")
 	pi.progressReporter.sendSystemMessage("Cleaning up...")
-	purgeFiles(pi.installDir, filesProvider.FilesToAdd())
-	pi.restoreBackups()
+	installReport.startRollback()
+
+	failed := purgeFiles(pi.installDir, filesProvider.FilesToAdd())
+	failed = append(failed, pi.restoreBackups()...)
+
 	pi.removeBackups()
 	cleanupEmptyDirs(pi.installDir)
+
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		logFields(LevelError, "Rollback incomplete", "files", failed)
+	} else {
+		log.Println("Rollback complete")
+	}
+
+	return failed
 }
 
 func (pi *PackageInstaller) teardown() {
@@ -185,7 +216,7 @@ func (pi *PackageInstaller) teardown() {
 }
 
 func copyFile(src, dst string) (err error) {
-	log.Printf("About to copy file %v to %v", src, dst)
+	logDebug("About to copy file %v to %v", src, dst)
 
 	fi, err := os.Stat(src)
 	if err != nil {
@@ -195,15 +226,19 @@ func copyFile(src, dst string) (err error) {
 
 	in, err := os.Open(src)
 	if err != nil {
-		log.Printf("Failed to open source: %v", err)
+		logError("Failed to open source: %v", err)
 		return err
 	}
 
 	defer in.Close()
 
-	out, err := os.OpenFile(dst, os.O_RDWR|os.O_TRUNC|os.O_CREATE, sourceMode)
+	return writeFile(dst, sourceMode, in)
+}
+
+func writeFile(dst string, mode os.FileMode, in io.Reader) (err error) {
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_TRUNC|os.O_CREATE, mode)
 	if err != nil {
-		log.Printf("Failed to create destination: %v", err)
+		logError("Failed to create destination: %v", err)
 		return
 	}
 
@@ -223,7 +258,7 @@ func copyFile(src, dst string) (err error) {
 }
 
 func (pi *PackageInstaller) backupFile(relpath string) error {
-	log.Printf("Backing up %v", relpath)
+	logDebug("Backing up %v", relpath)
 
 	oldpath := path.Join(pi.installDir, relpath)
 	backupPath := relpath + BackupExt
@@ -242,15 +277,19 @@ func (pi *PackageInstaller) backupFile(relpath string) error {
 			pi.backupsChan <- BackupPair{relpath: relpath, newpath: newpath}
 		}()
 	} else {
-		log.Printf("Backup failed: %v", err)
+		logError("Backup failed: %v", err)
 	}
 
 	return err
 }
 
-func (pi *PackageInstaller) restoreBackups() {
+// restoreBackups returns relative paths of the files that could not
+// be restored; their backups are kept in place
+func (pi *PackageInstaller) restoreBackups() []string {
 	log.Printf("Restoring %v backups", len(pi.backups))
 	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	failed := make([]string, 0)
 
 	for relpath, backuppath := range pi.backups {
 		wg.Add(1)
@@ -258,21 +297,62 @@ func (pi *PackageInstaller) restoreBackups() {
 		go func(relativePath, pathToRestore string) {
 			defer wg.Done()
 
-			oldpath := path.Join(pi.installDir, relativePath)
-			log.Printf("Restoring %v to %v", pathToRestore, oldpath)
-
-			// backups are supposed to be in the same location as files
-			// so rename operaion will not be screwed with by paths
-			// on different harddrives
-			err := os.Rename(pathToRestore, oldpath)
+			started := time.Now()
+			err := pi.restoreFile(relativePath, pathToRestore)
+			recordFileOp(opRestore, relativePath, 0, started, err)
 
 			if err != nil {
-				log.Printf("Error while restoring %v: %v", pathToRestore, err)
+				mutex.Lock()
+				failed = append(failed, relativePath)
+				mutex.Unlock()
 			}
 		}(relpath, backuppath)
 	}
 
 	wg.Wait()
+
+	for _, relpath := range failed {
+		logFields(LevelError, "Keeping backup that failed to restore", "path", relpath, "backup", pi.backups[relpath])
+		delete(pi.backups, relpath)
+	}
+
+	return failed
+}
+
+// restoreFile retries rename of the backup (something may be holding
+// the file for a moment) and falls back to copying it
+func (pi *PackageInstaller) restoreFile(relpath, backuppath string) (err error) {
+	oldpath := path.Join(pi.installDir, relpath)
+	logDebug("Restoring %v to %v", backuppath, oldpath)
+
+	for attempt := 1; attempt <= restoreAttempts; attempt++ {
+		// backups are supposed to be in the same location as files
+		// so rename operaion will not be screwed with by paths
+		// on different harddrives
+		err = os.Rename(backuppath, oldpath)
+		if err == nil {
+			return nil
+		}
+
+		logWarn("Error while restoring %v: %v. attempt=%v", relpath, err, attempt)
+		if attempt < restoreAttempts {
+			time.Sleep(restoreRetryDelay)
+		}
+	}
+
+	ensureDirExists(oldpath)
+
+	err = copyFile(backuppath, oldpath)
+	if err != nil {
+		return err
+	}
+
+	logFields(LevelInfo, "Restored file by copying", "path", relpath)
+	if rerr := os.Remove(backuppath); rerr != nil {
+		logWarn("Error while removing %v: %v", backuppath, rerr)
+	}
+
+	return nil
 }
 
 func (pi *PackageInstaller) removeOldBackups() {
@@ -283,7 +363,7 @@ func (pi *PackageInstaller) removeOldBackups() {
 	} else if os.IsNotExist(err) {
 		log.Println("Old installer backup was not found")
 	} else {
-		log.Printf("Error while removing old backup: %v", err)
+		logWarn("Error while removing old backup: %v", err)
 	}
 }
 
@@ -300,10 +380,11 @@ func (pi *PackageInstaller) removeBackups() {
 	}
 
 	for _, backuppath := range pi.backups {
-		log.Printf("Removing %v", backuppath)
+		logDebug("Removing %v", backuppath)
 		err := os.Remove(backuppath)
-		if err != nil {
-			log.Printf("Error while removing %v: %v", backuppath, err)
+		// restored backups are already gone
+		if (err != nil) && !os.IsNotExist(err) {
+			logWarn("Error while removing %v: %v", backuppath, err)
 		}
 
 		pi.progressReporter.accountBackupRemove()
@@ -319,13 +400,18 @@ func (pi *PackageInstaller) removeFiles(files []*UpdateFileInfo) error {
 		pathToRemove, filesize := fi.Filepath, fi.FileSize
 
 		fullpath := filepath.Join(pi.installDir, pathToRemove)
-		log.Printf("Removing file %v", fullpath)
+		logDebug("Removing file %v", fullpath)
+		pi.progressReporter.sendCurrentFile(pathToRemove)
+		started := time.Now()
 
 		// real removal will happen in the end when backup will be removed
 		err := pi.backupFile(pathToRemove)
+		recordFileOp(opRemove, pathToRemove, filesize, started, err)
 
 		if err != nil {
-			log.Printf("Removing file %v failed: %v", pathToRemove, err)
+			if pi.strictRemove {
+				return err
+			}
 		}
 
 		pi.progressReporter.accountRemove(filesize)
@@ -335,64 +421,116 @@ func (pi *PackageInstaller) removeFiles(files []*UpdateFileInfo) error {
 }
 
 func (pi *PackageInstaller) updateFiles(files []*UpdateFileInfo) error {
-	log.Printf("Updating %v files", len(files))
-	var err error
-
-	for _, fi := range files {
-		pathToUpdate, filesize := fi.Filepath, fi.FileSize
+	log.Printf("Updating %v files. jobs=%v", len(files), pi.jobs)
+	return forEachFile(files, pi.jobs, pi.updateFile)
+}
 
-		oldpath := path.Join(pi.installDir, pathToUpdate)
-		log.Printf("Updating file %v", oldpath)
+func (pi *PackageInstaller) updateFile(fi *UpdateFileInfo) error {
+	pathToUpdate, filesize := fi.Filepath, fi.FileSize
 
-		err = pi.backupFile(pathToUpdate)
-		if err != nil {
-			log.Printf("Error while backing up %v: %v", pathToUpdate, err)
-		}
+	oldpath := path.Join(pi.installDir, pathToUpdate)
+	logDebug("Updating file %v", oldpath)
+	pi.progressReporter.sendCurrentFile(pathToUpdate)
+	started := time.Now()
 
-		newpath := path.Join(pi.packageDir, pathToUpdate)
-		err = os.Remove(oldpath)
-		if err != nil {
-			log.Printf("Error while removing %v: %v", oldpath, err)
-		}
-
-		// just os.Rename does not work if files are on different drive
-		err = copyFile(newpath, oldpath)
-		pi.progressReporter.accountUpdate(filesize)
+	err := pi.backupFile(pathToUpdate)
+	if err != nil {
+		logError("Error while backing up %v: %v", pathToUpdate, err)
+	}
 
-		if err != nil {
-			log.Printf("Updating file %v failed: %v", pathToUpdate, err)
-			break
-		}
+	err = os.Remove(oldpath)
+	if err != nil {
+		logWarn("Error while removing %v: %v", oldpath, err)
 	}
 
+	// just os.Rename does not work if files are on different drive
+	err = installFile(pi.pkg, pathToUpdate, oldpath)
+	pi.progressReporter.accountUpdate(filesize)
+	recordFileOp(opUpdate, pathToUpdate, filesize, started, err)
+
 	return err
 }
 
 func (pi *PackageInstaller) addFiles(files []*UpdateFileInfo) error {
-	log.Printf("Adding %v files", len(files))
+	log.Printf("Adding %v files. jobs=%v", len(files), pi.jobs)
+	return forEachFile(files, pi.jobs, pi.addFile)
+}
 
-	for _, fi := range files {
-		pathToAdd, filesize := fi.Filepath, fi.FileSize
+func (pi *PackageInstaller) addFile(fi *UpdateFileInfo) error {
+	pathToAdd, filesize := fi.Filepath, fi.FileSize
 
-		oldpath := path.Join(pi.installDir, pathToAdd)
-		ensureDirExists(oldpath)
+	oldpath := path.Join(pi.installDir, pathToAdd)
+	started := time.Now()
+	ensureDirExists(oldpath)
 
-		log.Printf("Adding file %v", pathToAdd)
+	logDebug("Adding file %v", pathToAdd)
+	pi.progressReporter.sendCurrentFile(pathToAdd)
 
-		newpath := path.Join(pi.packageDir, pathToAdd)
-		err := copyFile(newpath, oldpath)
+	err := installFile(pi.pkg, pathToAdd, oldpath)
+	recordFileOp(opAdd, pathToAdd, filesize, started, err)
 
-		if err != nil {
-			log.Printf("Adding file %v failed: %v", pathToAdd, err)
-			return err
-		} else {
-			pi.progressReporter.accountAdd(filesize)
-		}
+	if err != nil {
+		return err
 	}
 
+	pi.progressReporter.accountAdd(filesize)
 	return nil
 }
 
+// forEachFile runs independent file operations with up to jobs workers.
+// First failure cancels operations that have not started yet
+func forEachFile(files []*UpdateFileInfo, jobs int, op func(fi *UpdateFileInfo) error) error {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+
+	limiter := NewLimiter(jobs)
+	cancel := make(chan struct{})
+
+	isCancelled := func() bool {
+		select {
+		case <-cancel:
+			return true
+		default:
+			return false
+		}
+	}
+
+	for _, fi := range files {
+		limiter.Acquire()
+
+		if isCancelled() {
+			limiter.Release()
+			break
+		}
+
+		wg.Add(1)
+		go func(fi *UpdateFileInfo) {
+			defer wg.Done()
+			defer limiter.Release()
+
+			if isCancelled() {
+				return
+			}
+
+			if err := op(fi); err != nil {
+				once.Do(func() {
+					firstErr = err
+					close(cancel)
+				})
+			}
+		}(fi)
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		logFields(LevelError, "File operations cancelled", "error", firstErr)
+	}
+
+	return firstErr
+}
+
 func (pi *PackageInstaller) removeSelfIfNeeded() {
 	if len(pi.removeSelfPath) == 0 {
 		log.Println("No need to remove itself")
@@ -409,27 +547,34 @@ func (pi *PackageInstaller) removeSelfIfNeeded() {
 	}
 }
 
-func purgeFiles(root string, files []*UpdateFileInfo) {
+// purgeFiles removes added files and returns relative paths
+// of the ones that could not be removed
+func purgeFiles(root string, files []*UpdateFileInfo) []string {
 	log.Printf("Purging %v files", len(files))
+	failed := make([]string, 0)
 
 	for _, fi := range files {
 		fullpath := path.Join(root, fi.Filepath)
-		log.Printf("Purging file %v", fullpath)
+		logDebug("Purging file %v", fullpath)
 		err := os.Remove(fullpath)
-		if err != nil {
-			log.Printf("Error while purging %v: %v", fullpath, err)
+		// files that were not added yet are missing
+		if (err != nil) && !os.IsNotExist(err) {
+			logError("Error while purging %v: %v", fullpath, err)
+			failed = append(failed, fi.Filepath)
 		}
 	}
 
 	log.Println("Finished purging files")
+
+	return failed
 }
 
 func ensureDirExists(fullpath string) (err error) {
-	log.Printf("Ensuring directory exists for %v", fullpath)
+	logDebug("Ensuring directory exists for %v", fullpath)
 	dirpath := path.Dir(fullpath)
-	err = os.MkdirAll(dirpath, os.ModeDir)
+	err = os.MkdirAll(dirpath, 0755)
 	if err != nil {
-		log.Printf("Failed to create directory %v", dirpath)
+		logError("Failed to create directory %v", dirpath)
 	}
 
 	return err
@@ -463,7 +608,7 @@ func cleanupEmptyDirs(root string) {
 	})
 
 	if err != nil {
-		log.Printf("Error while cleaning up empty dirs: %v", err)
+		logWarn("Error while cleaning up empty dirs: %v", err)
 	}
 
 	removeEmptyDirs(dirs)
@@ -479,108 +624,12 @@ func removeEmptyDirs(dirs []string) {
 		}
 
 		if len(entries) == 0 {
-			log.Printf("Removing empty dir %v", dirpath)
+			logDebug("Removing empty dir %v", dirpath)
 
 			err = os.Remove(dirpath)
 			if err != nil {
-				log.Printf("Error while removing dir %v: %v", dirpath, err)
+				logWarn("Error while removing dir %v: %v", dirpath, err)
 			}
 		}
 	}
 }
-
-func (pr *ProgressReporter) accountRemove(progress int64) {
-	pr.progressWG.Add(1)
-	go func() {
-		pr.progressChan <- (progress * RemoveFactor) / 100
-	}()
-}
-
-func (pr *ProgressReporter) accountUpdate(progress int64) {
-	pr.progressWG.Add(1)
-	go func() {
-		pr.progressChan <- (progress * UpdateFactor) / 100
-	}()
-}
-
-func (pr *ProgressReporter) accountAdd(progress int64) {
-	pr.progressWG.Add(1)
-	go func() {
-		pr.progressChan <- (progress * AddFactor) / 100
-	}()
-}
-
-func (pr *ProgressReporter) accountBackupRemove() {
-	// exact size of files is not known when removeBackups()
-	// so using some arbitrary value (fair dice roll)
-	pr.progressWG.Add(1)
-	go func() {
-		pr.progressChan <- RemoveBackupPrice
-	}()
-}
-
-func (pr *ProgressReporter) reportingLoop() {
-	for chunk := range pr.progressChan {
-		pr.currentProgress += uint64(chunk)
-
-		percent := (pr.currentProgress * 100) / pr.grandTotal
-
-		percentsChanged := int(percent) > pr.percent
-		pr.percent = int(percent)
-
-		if percentsChanged {
-			pr.progressHandler.HandlePercentChange(pr.percent)
-		}
-
-		pr.progressWG.Done()
-	}
-
-	log.Println("Reporting loop finished")
-}
-
-func (pr *ProgressReporter) waitProgressReported() {
-	log.Println("Waiting for progress reporting to finish")
-	pr.progressWG.Wait()
-}
-
-func (pr *ProgressReporter) shutdown() {
-	log.Println("Shutting down progress reporter...")
-	close(pr.progressChan)
-	go func() {
-		pr.finished <- true
-	}()
-}
-
-func (pr *ProgressReporter) sendSystemMessage(msg string) {
-	pr.systemMessageChan <- msg
-}
-
-func (pr *ProgressReporter) receiveSystemMessages() {
-	for msg := range pr.systemMessageChan {
-		pr.progressHandler.HandleSystemMessage(msg)
-	}
-
-	log.Println("System messages handling finished")
-}
-
-func (pr *ProgressReporter) receiveFinish() {
-	log.Println("Waiting for teardown and global finish...")
-	<-pr.finished
-	pr.progressHandler.HandleFinish()
-}
-
-func (pr *ProgressReporter) handleProgress() {
-	go pr.receiveSystemMessages()
-}
-
-func (ph *LogProgressHandler) HandlePercentChange(percent int) {
-	log.Printf("Completed %v%%", percent)
-}
-
-func (ph *LogProgressHandler) HandleSystemMessage(msg string) {
-	log.Printf("System message: %v", msg)
-}
-
-func (ph *LogProgressHandler) HandleFinish() {
-	log.Println("Finished")
-}
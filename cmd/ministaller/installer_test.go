@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+func TestForEachFileStopsOnError(t *testing.T) {
+	files := make([]*UpdateFileInfo, 100)
+	for i := range files {
+		files[i] = &UpdateFileInfo{Filepath: fmt.Sprintf("file%v", i)}
+	}
+
+	expected := errors.New("copy failed")
+	var started int32
+
+	err := forEachFile(files, 1, func(fi *UpdateFileInfo) error {
+		if atomic.AddInt32(&started, 1) == 3 {
+			return expected
+		}
+
+		return nil
+	})
+
+	if err != expected {
+		t.Errorf("forEachFile returned %v, expected %v", err, expected)
+	}
+
+	if n := atomic.LoadInt32(&started); n != 3 {
+		t.Errorf("%v operations started after the failure, expected none", n-3)
+	}
+}
+
+func BenchmarkForEachFileCopy(b *testing.B) {
+	srcDir, err := ioutil.TempDir("", "foreach-src")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+
+	dstDir, err := ioutil.TempDir("", "foreach-dst")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dstDir)
+
+	paths := createBenchmarkFiles(b, srcDir)
+	files := make([]*UpdateFileInfo, 0, len(paths))
+	for _, p := range paths {
+		files = append(files, &UpdateFileInfo{Filepath: filepath.Base(p), FileSize: benchmarkFileSize})
+	}
+
+	srcDir = filepath.ToSlash(srcDir)
+	dstDir = filepath.ToSlash(dstDir)
+
+	for _, jobs := range benchmarkJobs {
+		b.Run(fmt.Sprintf("jobs=%v", jobs), func(b *testing.B) {
+			b.SetBytes(benchmarkFilesCount * benchmarkFileSize)
+
+			for i := 0; i < b.N; i++ {
+				err := forEachFile(files, jobs, func(fi *UpdateFileInfo) error {
+					return copyFile(path.Join(srcDir, fi.Filepath), path.Join(dstDir, fi.Filepath))
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRollbackContinuesAfterRestoreFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("health check script requires sh")
+	}
+
+	root, err := ioutil.TempDir("", "rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	installDir := filepath.Join(root, "app")
+	oldFiles := map[string]string{"a.txt": "old a", "b.txt": "old b", "lib/c.txt": "old c"}
+	writeTree(t, installDir, oldFiles)
+
+	// health check replaces a.txt with a dir so its backup cannot be restored
+	packagePath := writePackage(t, root, map[string]string{
+		"a.txt":     "new a",
+		"b.txt":     "new b",
+		"lib/c.txt": "new c",
+		"d.txt":     "new d",
+		"check.sh":  "#!/bin/sh\nrm a.txt && mkdir -p a.txt/dir\nexit 1\n",
+	})
+
+	err = runInstall(t, map[string]string{
+		"install-path": installDir,
+		"package-path": packagePath,
+		"health-exe":   "check.sh",
+		"keep-missing": "true",
+	})
+
+	var re *RollbackError
+	if !errors.As(err, &re) {
+		t.Fatalf("install returned %v, expected rollback error", err)
+	}
+
+	if (len(re.Files) != 1) || (re.Files[0] != "a.txt") {
+		t.Errorf("not restored files are %v, expected [a.txt]", re.Files)
+	}
+
+	if code := exitCode(err); code != exitCodeRollbackFailed {
+		t.Errorf("exit code %v, expected %v", code, exitCodeRollbackFailed)
+	}
+
+	if installReport.Status != statusRollbackFailed {
+		t.Errorf("report status %v, expected %v", installReport.Status, statusRollbackFailed)
+	}
+
+	// rollback went on after a.txt failed
+	checkTree(t, installDir, map[string]string{"b.txt": "old b", "lib/c.txt": "old c"})
+
+	for _, relpath := range []string{"d.txt", "check.sh"} {
+		if _, err := os.Stat(filepath.Join(installDir, relpath)); !os.IsNotExist(err) {
+			t.Errorf("added file %v was not removed", relpath)
+		}
+	}
+
+	// unrestored backup is kept for manual recovery
+	if _, err := os.Stat(filepath.Join(installDir, "a.txt"+BackupExt)); err != nil {
+		t.Errorf("backup of a.txt was not kept: %v", err)
+	}
+}
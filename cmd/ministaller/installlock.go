@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+)
+
+const (
+	LockFileExt       = ".lock"
+	lockRetryInterval = time.Second
+)
+
+var errLockBusy = errors.New("lock is held by another process")
+
+// LockOwner is written into the lock file by the process holding it
+type LockOwner struct {
+	PID     int       `json:"pid"`
+	Started time.Time `json:"started"`
+	Host    string    `json:"host"`
+}
+
+func (lo *LockOwner) String() string {
+	return fmt.Sprintf("pid %v on %v since %v", lo.PID, lo.Host, lo.Started.Format(time.RFC3339))
+}
+
+// LockBusyError is returned when another ministaller holds the lock
+type LockBusyError struct {
+	Path  string
+	Owner *LockOwner
+}
+
+func (le *LockBusyError) Error() string {
+	if le.Owner == nil {
+		return fmt.Sprintf("install dir is locked by another ministaller (%v)", le.Path)
+	}
+
+	return fmt.Sprintf("install dir is locked by another ministaller: %v (%v)", le.Owner, le.Path)
+}
+
+// InstallLock is an advisory lock preventing concurrent runs in one install dir
+type InstallLock struct {
+	path string
+	file *os.File
+}
+
+// lockFilePath returns path of the lock file for install dir which is
+// kept next to it so the install dir can be swapped while locked
+func lockFilePath(dir string) string {
+	return path.Clean(dir) + LockFileExt
+}
+
+// AcquireInstallLock takes the lock for dir waiting up to wait duration
+func AcquireInstallLock(dir string, wait time.Duration) (*InstallLock, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	lockPath := lockFilePath(dir)
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	waitLogged := false
+
+	for {
+		err = lockFile(f)
+		if err == nil {
+			break
+		}
+
+		if err != errLockBusy {
+			f.Close()
+			return nil, err
+		}
+
+		owner := readLockOwner(f)
+
+		if (owner != nil) && !isProcessAlive(owner.PID) {
+			logFields(LevelInfo, "Lock holder is not running, lock is probably inherited by its child", "owner", owner)
+		}
+
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, &LockBusyError{Path: lockPath, Owner: owner}
+		}
+
+		if !waitLogged {
+			logFields(LevelInfo, "Waiting for install lock", "owner", owner, "timeout", wait)
+			waitLogged = true
+		}
+
+		time.Sleep(lockRetryInterval)
+	}
+
+	if owner := readLockOwner(f); owner != nil {
+		logFields(LevelInfo, "Found stale install lock", "owner", owner)
+	}
+
+	il := &InstallLock{path: lockPath, file: f}
+
+	err = il.writeOwner()
+	if err != nil {
+		il.Release()
+		return nil, err
+	}
+
+	logFields(LevelInfo, "Install lock acquired", "path", lockPath)
+
+	return il, nil
+}
+
+func (il *InstallLock) writeOwner() error {
+	host, _ := os.Hostname()
+	owner := &LockOwner{
+		PID:     os.Getpid(),
+		Started: time.Now(),
+		Host:    host,
+	}
+
+	data, err := json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+
+	err = il.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	_, err = il.file.WriteAt(data, 0)
+	if err != nil {
+		return err
+	}
+
+	return il.file.Sync()
+}
+
+// Release clears owner info and unlocks the lock file
+// (file itself is not removed to avoid racing with waiters)
+func (il *InstallLock) Release() {
+	if il == nil {
+		return
+	}
+
+	logFields(LevelInfo, "Releasing install lock", "path", il.path)
+
+	il.file.Truncate(0)
+
+	err := unlockFile(il.file)
+	if err != nil {
+		logWarn("Error while unlocking %v: %v", il.path, err)
+	}
+
+	il.file.Close()
+}
+
+func readLockOwner(f *os.File) *LockOwner {
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if (err != nil) || (len(data) == 0) {
+		return nil
+	}
+
+	owner := &LockOwner{}
+	if err := json.Unmarshal(data, owner); err != nil {
+		return nil
+	}
+
+	return owner
+}
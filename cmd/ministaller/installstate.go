@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+const (
+	StateFileName = "state.json"
+)
+
+// InstallState is what ministaller remembers about the installation
+// in <install-path>/.ministaller/state.json
+type InstallState struct {
+	Version       string            `json:"version"`
+	Layout        string            `json:"layout"`
+	Components    []string          `json:"components"`
+	UninstallHook string            `json:"uninstall_hook,omitempty"`
+	Files         []*UpdateFileInfo `json:"files"` // installed from the package
+	Updated       time.Time         `json:"updated"`
+}
+
+// ReadInstallState returns nil state if nothing was installed yet
+func ReadInstallState(installDir string) (*InstallState, error) {
+	data, err := ioutil.ReadFile(path.Join(installDir, DataDirName, StateFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &InstallState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// RecordFiles remembers package files present in targetDir after
+// install so that uninstall removes only them; previously recorded
+// files kept with --keep-missing stay recorded
+func (s *InstallState) RecordFiles(targetDir string, df *DiffGenerator) {
+	previous := s.Files
+	s.Files = make([]*UpdateFileInfo, 0, len(df.pkg.Files()))
+
+	for _, fi := range previous {
+		if _, ok := df.pkg.Files()[fi.Filepath]; ok {
+			continue
+		}
+
+		if _, err := os.Stat(path.Join(targetDir, fi.Filepath)); err == nil {
+			s.Files = append(s.Files, fi)
+		}
+	}
+
+	for relpath, fi := range df.pkg.Files() {
+		if !df.components.Includes(relpath) {
+			continue
+		}
+
+		if _, err := os.Stat(path.Join(targetDir, relpath)); err != nil {
+			continue
+		}
+
+		s.Files = append(s.Files, &UpdateFileInfo{
+			Filepath: relpath,
+			Sha1:     df.packageDirHashes[relpath],
+			FileSize: fi.FileSize,
+		})
+	}
+
+	sort.Slice(s.Files, func(i, j int) bool {
+		return s.Files[i].Filepath < s.Files[j].Filepath
+	})
+}
+
+// Write replaces the state file atomically
+func (s *InstallState) Write(installDir string) error {
+	stateDir := path.Join(installDir, DataDirName)
+	err := os.MkdirAll(stateDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	s.Updated = time.Now()
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	statePath := path.Join(stateDir, StateFileName)
+	tempPath := statePath + StagingExt
+
+	err = ioutil.WriteFile(tempPath, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tempPath, statePath)
+	if err != nil {
+		os.Remove(tempPath)
+		return err
+	}
+
+	logFields(LevelInfo, "Install state saved", "path", statePath, "components", s.Components)
+
+	return nil
+}
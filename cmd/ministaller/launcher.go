@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// waitForProcess waits for the application that started ministaller
+// to exit so that its files are not locked during install
+func waitForProcess(pid int, timeout time.Duration) error {
+	if !isProcessAlive(pid) {
+		logFields(LevelInfo, "Process already exited", "pid", pid)
+		return nil
+	}
+
+	logFields(LevelInfo, "Waiting for process to exit", "pid", pid, "timeout", timeout)
+	deadline := time.Now().Add(timeout)
+
+	for isProcessAlive(pid) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("process %v did not exit in %v", pid, timeout)
+		}
+
+		time.Sleep(processPollInterval)
+	}
+
+	logFields(LevelInfo, "Process exited", "pid", pid)
+	return nil
+}
+
+// launchApp starts launch-exe from the install dir telling it
+// the result of the update
+func launchApp(result string) error {
+	exePath := resolveCommandPath(*installPathFlag, *launchExeFlag)
+
+	args := append([]string{}, launchArgFlag...)
+	if len(*launchArgsFlag) > 0 {
+		args = append(args, *launchArgsFlag)
+	}
+	if len(*launchResultArgFlag) > 0 {
+		args = append(args, *launchResultArgFlag+"="+result)
+	}
+
+	logFields(LevelInfo, "Trying to launch exe", "path", exePath, "args", fmt.Sprintf("%q", args), "dir", *launchDirFlag, "detached", *launchDetachedFlag, "result", result)
+
+	cmd := exec.Command(exePath, args...)
+	cmd.Dir = filepath.FromSlash(*launchDirFlag)
+	cmd.Env = append(append(os.Environ(), launchEnvFlag...), envPrefix+"RESULT="+result)
+
+	if *launchDetachedFlag {
+		setDetached(cmd)
+	}
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	logFields(LevelInfo, "Launched exe", "pid", cmd.Process.Pid)
+
+	// ministaller exits without waiting for the app
+	return cmd.Process.Release()
+}
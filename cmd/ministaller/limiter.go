@@ -0,0 +1,20 @@
+package main
+
+// Limiter bounds the number of concurrently running jobs
+type Limiter chan struct{}
+
+func NewLimiter(jobs int) Limiter {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	return make(Limiter, jobs)
+}
+
+func (l Limiter) Acquire() {
+	l <- struct{}{}
+}
+
+func (l Limiter) Release() {
+	<-l
+}
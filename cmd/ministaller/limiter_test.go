@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var benchmarkJobs = []int{1, 2, 4, 8}
+
+const (
+	benchmarkFilesCount = 64
+	benchmarkFileSize   = 256 * 1024
+	benchmarkTreeDirs   = 16
+)
+
+// createBenchmarkFiles writes files with pseudo-random content
+func createBenchmarkFiles(b *testing.B, dir string) []string {
+	data := make([]byte, benchmarkFileSize)
+	for i := range data {
+		data[i] = byte(i * 31)
+	}
+
+	paths := make([]string, 0, benchmarkFilesCount)
+	for i := 0; i < benchmarkFilesCount; i++ {
+		fullpath := filepath.Join(dir, fmt.Sprintf("file%03d.bin", i))
+		data[0] = byte(i)
+
+		if err := ioutil.WriteFile(fullpath, data, 0644); err != nil {
+			b.Fatal(err)
+		}
+
+		paths = append(paths, filepath.ToSlash(fullpath))
+	}
+
+	return paths
+}
+
+// createBenchmarkTree writes benchmarkTreeDirs dirs of benchmark files;
+// files with index divisible by changeEvery get different content
+func createBenchmarkTree(b *testing.B, root string, changeEvery int) {
+	for i := 0; i < benchmarkTreeDirs; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%02d", i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+
+		paths := createBenchmarkFiles(b, dir)
+		if changeEvery == 0 {
+			continue
+		}
+
+		for j := 0; j < len(paths); j += changeEvery {
+			if err := ioutil.WriteFile(paths[j], []byte("changed"), 0644); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkCalculateHashes(b *testing.B) {
+	root, err := ioutil.TempDir("", "hashes")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	createBenchmarkTree(b, root, 0)
+	root = filepath.ToSlash(root)
+
+	for _, jobs := range benchmarkJobs {
+		b.Run(fmt.Sprintf("jobs=%v", jobs), func(b *testing.B) {
+			b.SetBytes(benchmarkTreeDirs * benchmarkFilesCount * benchmarkFileSize)
+
+			for i := 0; i < b.N; i++ {
+				hashes := CalculateHashes(root, ioutil.Discard, NewLimiter(jobs))
+				if len(hashes) != benchmarkTreeDirs*benchmarkFilesCount {
+					b.Fatalf("%v files hashed", len(hashes))
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGenerateDiffs(b *testing.B) {
+	root, err := ioutil.TempDir("", "diffs")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	installDir := filepath.Join(root, "install")
+	packageDir := filepath.Join(root, "package")
+	createBenchmarkTree(b, installDir, 0)
+	createBenchmarkTree(b, packageDir, 4)
+
+	pkg, err := NewDirPackage(filepath.ToSlash(packageDir))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, jobs := range benchmarkJobs {
+		b.Run(fmt.Sprintf("jobs=%v", jobs), func(b *testing.B) {
+			b.SetBytes(2 * benchmarkTreeDirs * benchmarkFilesCount * benchmarkFileSize)
+
+			for i := 0; i < b.N; i++ {
+				pr := NewProgressReporter(&LogProgressHandler{}, PhaseDiff)
+				go pr.handleProgress()
+
+				df := newDiffGenerator(filepath.ToSlash(installDir), pkg, pr, jobs)
+				if err := df.GenerateDiffs(); err != nil {
+					b.Fatal(err)
+				}
+
+				pr.waitProgressReported()
+				pr.shutdown()
+				pr.receiveFinish()
+
+				if len(df.FilesToUpdate()) == 0 {
+					b.Fatal("no files to update found")
+				}
+			}
+		})
+	}
+}
+
+func newDiffGenerator(installDir string, pkg Package, pr *ProgressReporter, jobs int) *DiffGenerator {
+	return &DiffGenerator{
+		filesToAdd:         make([]*UpdateFileInfo, 0),
+		filesToRemove:      make([]*UpdateFileInfo, 0),
+		filesToUpdate:      make([]*UpdateFileInfo, 0),
+		filesToAddQueue:    make(chan *UpdateFileInfo),
+		filesToRemoveQueue: make(chan *UpdateFileInfo),
+		filesToUpdateQueue: make(chan *UpdateFileInfo),
+		errors:             make(chan error, 1),
+		installDirHashes:   make(map[string]string),
+		packageDirHashes:   make(map[string]string),
+		installDirPath:     installDir,
+		pkg:                pkg,
+		progressReporter:   pr,
+		jobs:               NewLimiter(jobs)}
+}
+
+func BenchmarkLimiterOverhead(b *testing.B) {
+	for _, jobs := range benchmarkJobs {
+		b.Run(fmt.Sprintf("jobs=%v", jobs), func(b *testing.B) {
+			limiter := NewLimiter(jobs)
+			var wg sync.WaitGroup
+
+			for i := 0; i < b.N; i++ {
+				wg.Add(1)
+				limiter.Acquire()
+
+				go func() {
+					defer wg.Done()
+					limiter.Release()
+				}()
+			}
+
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	logFormatText   = "text"
+	logFormatJSON   = "json"
+	logFormatLogfmt = "logfmt"
+)
+
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// level tags prepended to messages by logDebug(), logWarn() and logError()
+var levelTags = []string{"DEBUG: ", "", "WARN: ", "ERROR: "}
+
+// logField is a key/value pair passed to logFields()
+type logField struct {
+	key   string
+	value string
+}
+
+// LogWriter is the output of the standard logger that filters
+// messages by level and formats them as text, JSON or logfmt records
+type LogWriter struct {
+	mutex  sync.Mutex
+	out    io.Writer
+	format string
+	level  int
+	runID  string
+	phase  string
+}
+
+var logWriter *LogWriter
+
+func NewLogWriter(out io.Writer, format, level, runID string) (*LogWriter, error) {
+	lw := &LogWriter{out: out, format: format, runID: runID}
+
+	switch format {
+	case logFormatText, logFormatJSON, logFormatLogfmt:
+	default:
+		return nil, fmt.Errorf("unknown log format: %v", format)
+	}
+
+	var ok bool
+	lw.level, ok = parseLogLevel(level)
+	if !ok {
+		return nil, fmt.Errorf("unknown log level: %v", level)
+	}
+
+	return lw, nil
+}
+
+func parseLogLevel(name string) (int, bool) {
+	for i, levelName := range levelNames {
+		if levelName == name {
+			return i, true
+		}
+	}
+
+	return LevelInfo, false
+}
+
+// newRunID generates random id to correlate records of one run
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func (lw *LogWriter) setPhase(phase string) {
+	if lw == nil {
+		return
+	}
+
+	lw.mutex.Lock()
+	lw.phase = phase
+	lw.mutex.Unlock()
+}
+
+// Write receives messages of the standard logger; the whole
+// message (without level tag) becomes msg of the record
+func (lw *LogWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+
+	level := LevelInfo
+	for i, tag := range levelTags {
+		if (len(tag) > 0) && strings.HasPrefix(line, tag) {
+			level = i
+			line = strings.TrimPrefix(line, tag)
+		}
+	}
+
+	if err := lw.writeRecord(time.Now(), level, line, nil); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (lw *LogWriter) writeRecord(now time.Time, level int, msg string, fields []logField) error {
+	lw.mutex.Lock()
+	defer lw.mutex.Unlock()
+
+	if level < lw.level {
+		return nil
+	}
+
+	var buf bytes.Buffer
+
+	switch lw.format {
+	case logFormatJSON:
+		lw.formatJSON(&buf, now, level, msg, fields)
+	case logFormatLogfmt:
+		lw.formatLogfmt(&buf, now, level, msg, fields)
+	default:
+		buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+		buf.WriteString(levelTags[level])
+		buf.WriteString(formatText(msg, fields))
+	}
+
+	buf.WriteByte('\n')
+
+	_, err := lw.out.Write(buf.Bytes())
+	return err
+}
+
+func (lw *LogWriter) formatJSON(buf *bytes.Buffer, now time.Time, level int, msg string, fields []logField) {
+	record := make(map[string]interface{}, len(fields)+5)
+	for _, f := range fields {
+		record[f.key] = f.value
+	}
+
+	record["time"] = now.Format(time.RFC3339Nano)
+	record["level"] = levelNames[level]
+	record["run_id"] = lw.runID
+	record["msg"] = msg
+	if len(lw.phase) > 0 {
+		record["phase"] = lw.phase
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		data = []byte(strconv.Quote(formatText(msg, fields)))
+	}
+
+	buf.Write(data)
+}
+
+func (lw *LogWriter) formatLogfmt(buf *bytes.Buffer, now time.Time, level int, msg string, fields []logField) {
+	fmt.Fprintf(buf, "time=%v level=%v run_id=%v", now.Format(time.RFC3339Nano), levelNames[level], lw.runID)
+	if len(lw.phase) > 0 {
+		fmt.Fprintf(buf, " phase=%v", lw.phase)
+	}
+	fmt.Fprintf(buf, " msg=%v", logfmtValue(msg))
+
+	for _, f := range fields {
+		fmt.Fprintf(buf, " %v=%v", f.key, logfmtValue(f.value))
+	}
+}
+
+// formatText renders fields in "Message. key=value key2=value2" style
+func formatText(msg string, fields []logField) string {
+	if len(fields) == 0 {
+		return msg
+	}
+
+	var sb strings.Builder
+	sb.WriteString(msg)
+	sb.WriteString(".")
+
+	for _, f := range fields {
+		fmt.Fprintf(&sb, " %v=%v", f.key, logfmtValue(f.value))
+	}
+
+	return sb.String()
+}
+
+func logfmtValue(s string) string {
+	if (len(s) > 0) && !strings.ContainsAny(s, " \t\"=") {
+		return s
+	}
+
+	return strconv.Quote(s)
+}
+
+func logDebug(format string, args ...interface{}) {
+	log.Output(2, levelTags[LevelDebug]+fmt.Sprintf(format, args...))
+}
+
+func logWarn(format string, args ...interface{}) {
+	log.Output(2, levelTags[LevelWarn]+fmt.Sprintf(format, args...))
+}
+
+func logError(format string, args ...interface{}) {
+	log.Output(2, levelTags[LevelError]+fmt.Sprintf(format, args...))
+}
+
+// logFields logs msg with key/value pairs (kv is key1, value1, key2, ...)
+// which structured formats keep as separate fields
+func logFields(level int, msg string, kv ...interface{}) {
+	fields := make([]logField, 0, (len(kv)+1)/2)
+	for i := 0; i < len(kv); i += 2 {
+		f := logField{key: fmt.Sprint(kv[i]), value: "(MISSING)"}
+		if i+1 < len(kv) {
+			f.value = fmt.Sprint(kv[i+1])
+		}
+		fields = append(fields, f)
+	}
+
+	if logWriter == nil {
+		log.Output(2, levelTags[level]+formatText(msg, fields))
+		return
+	}
+
+	if err := logWriter.writeRecord(time.Now(), level, msg, fields); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write log: %v\n", err)
+	}
+}
+
+// logFileOp records result and duration of the file operation
+func logFileOp(op, relpath string, started time.Time, err error) {
+	duration := time.Since(started)
+
+	if err != nil {
+		logFields(LevelError, "File operation failed", "operation", op, "file", relpath, "duration", duration, "error", err)
+		return
+	}
+
+	logFields(LevelDebug, "File operation finished", "operation", op, "file", relpath, "duration", duration)
+}
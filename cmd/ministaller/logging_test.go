@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLogWriter(t *testing.T, format, level string) (*LogWriter, *bytes.Buffer) {
+	var buf bytes.Buffer
+
+	lw, err := NewLogWriter(&buf, format, level, "run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return lw, &buf
+}
+
+var testFields = []logField{
+	{"path", "/opt/my app/file=1.txt"},
+	{"error", "open /opt/x: no such file path=y"},
+	{"count", "3"},
+}
+
+func TestLogWriterJSONFields(t *testing.T) {
+	lw, buf := newTestLogWriter(t, logFormatJSON, "debug")
+
+	if err := lw.writeRecord(time.Now(), LevelWarn, "Copy failed", testFields); err != nil {
+		t.Fatal(err)
+	}
+
+	record := make(map[string]string)
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("invalid JSON record %q: %v", buf.String(), err)
+	}
+
+	expected := map[string]string{
+		"msg":    "Copy failed",
+		"level":  "warn",
+		"run_id": "run1",
+		"path":   "/opt/my app/file=1.txt",
+		"error":  "open /opt/x: no such file path=y",
+		"count":  "3",
+	}
+
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("%v = %q, expected %q", key, record[key], value)
+		}
+	}
+
+	if len(record) != len(expected)+1 {
+		t.Errorf("unexpected fields in %v", record)
+	}
+}
+
+func TestLogWriterLogfmtFields(t *testing.T) {
+	lw, buf := newTestLogWriter(t, logFormatLogfmt, "debug")
+
+	if err := lw.writeRecord(time.Now(), LevelInfo, "Copy failed", testFields); err != nil {
+		t.Fatal(err)
+	}
+
+	line := strings.TrimSpace(buf.String())
+	suffix := ` level=info run_id=run1 msg="Copy failed" path="/opt/my app/file=1.txt" error="open /opt/x: no such file path=y" count=3`
+	if !strings.HasPrefix(line, "time=") || !strings.HasSuffix(line, suffix) {
+		t.Errorf("unexpected logfmt record: %v", line)
+	}
+}
+
+func TestLogWriterTextFields(t *testing.T) {
+	lw, buf := newTestLogWriter(t, logFormatText, "debug")
+
+	if err := lw.writeRecord(time.Now(), LevelError, "Copy failed", testFields); err != nil {
+		t.Fatal(err)
+	}
+
+	suffix := ` ERROR: Copy failed. path="/opt/my app/file=1.txt" error="open /opt/x: no such file path=y" count=3`
+	if line := strings.TrimSpace(buf.String()); !strings.HasSuffix(line, suffix) {
+		t.Errorf("unexpected text record: %v", line)
+	}
+}
+
+func TestLogWriterPlainMessage(t *testing.T) {
+	lw, buf := newTestLogWriter(t, logFormatJSON, "debug")
+
+	// printf-style messages are not split into fields
+	msg := "Error while removing /opt/a b: op=remove failed. path=x"
+	if _, err := lw.Write([]byte(levelTags[LevelWarn] + msg + "\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	record := make(map[string]string)
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("invalid JSON record %q: %v", buf.String(), err)
+	}
+
+	if (record["msg"] != msg) || (record["level"] != "warn") {
+		t.Errorf("unexpected record: %v", record)
+	}
+
+	if _, ok := record["path"]; ok {
+		t.Errorf("message should not be parsed into fields: %v", record)
+	}
+}
+
+func TestLogWriterLevel(t *testing.T) {
+	lw, buf := newTestLogWriter(t, logFormatText, "warn")
+
+	lw.Write([]byte(levelTags[LevelDebug] + "debug message\n"))
+	lw.Write([]byte("info message\n"))
+	lw.writeRecord(time.Now(), LevelInfo, "info record", nil)
+	lw.Write([]byte(levelTags[LevelWarn] + "warn message\n"))
+	lw.writeRecord(time.Now(), LevelError, "error record", nil)
+
+	output := buf.String()
+	for _, skipped := range []string{"debug message", "info message", "info record"} {
+		if strings.Contains(output, skipped) {
+			t.Errorf("%q should be filtered out", skipped)
+		}
+	}
+
+	for _, kept := range []string{"WARN: warn message", "ERROR: error record"} {
+		if !strings.Contains(output, kept) {
+			t.Errorf("%q is missing in %q", kept, output)
+		}
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	lw, buf := newTestLogWriter(t, logFormatJSON, "debug")
+
+	saved := logWriter
+	logWriter = lw
+	defer func() { logWriter = saved }()
+
+	logFields(LevelError, "File operation failed", "operation", opUpdate, "duration", 2*time.Second, "error", errors.New("disk full"), "dangling")
+
+	record := make(map[string]string)
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("invalid JSON record %q: %v", buf.String(), err)
+	}
+
+	expected := map[string]string{
+		"msg":       "File operation failed",
+		"level":     "error",
+		"operation": opUpdate,
+		"duration":  "2s",
+		"error":     "disk full",
+		"dangling":  "(MISSING)",
+	}
+
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("%v = %q, expected %q", key, record[key], value)
+		}
+	}
+}
+
+func TestFormatText(t *testing.T) {
+	tests := []struct {
+		msg      string
+		fields   []logField
+		expected string
+	}{
+		{"Plain message", nil, "Plain message"},
+		{"Install lock acquired", []logField{{"path", "/opt/app.lock"}}, "Install lock acquired. path=/opt/app.lock"},
+		{"Empty", []logField{{"value", ""}}, `Empty. value=""`},
+		{"Quoted", []logField{{"value", `say "hi"`}}, `Quoted. value="say \"hi\""`},
+	}
+
+	for _, tt := range tests {
+		if got := formatText(tt.msg, tt.fields); got != tt.expected {
+			t.Errorf("formatText(%q) = %q, expected %q", tt.msg, got, tt.expected)
+		}
+	}
+}
@@ -3,16 +3,17 @@ package main
 import (
 	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"os/exec"
 	"path"
 	"path/filepath"
-	"regexp"
+	"runtime"
 	"strings"
+	"time"
 
 	"gopkg.in/natefinch/lumberjack.v2"
 )
@@ -31,34 +32,114 @@ func (af *arrayFlags) Set(value string) error {
 // flags
 var (
 	excludePatternsFlag arrayFlags
+	includePatternsFlag arrayFlags
+	launchArgFlag       arrayFlags
+	launchEnvFlag       arrayFlags
 	installPathFlag     = flag.String("install-path", "", "Path to the existing installation")
 	packagePathFlag     = flag.String("package-path", "", "Path to package with updates")
 	forceUpdateFlag     = flag.Bool("force-update", false, "Overwrite same files")
 	keepMissingFlag     = flag.Bool("keep-missing", false, "Keep files not found in the update package")
 	logPathFlag         = flag.String("l", "ministaller.log", "absolute path to log file")
 	launchExeFlag       = flag.String("launch-exe", "", "relative path to exe to launch after install")
-	launchArgsFlag      = flag.String("launch-args", "", "arguments for launch-exe")
+	launchArgsFlag      = flag.String("launch-args", "", "single argument for launch-exe (deprecated: use launch-arg)")
+	launchDirFlag       = flag.String("launch-dir", "", "Working dir of launch-exe (defaults to the current dir)")
+	launchDetachedFlag  = flag.Bool("launch-detached", false, "Start launch-exe detached from ministaller's session and console")
+	launchResultArgFlag = flag.String("launch-result-arg", "", "Argument passed to launch-exe as <arg>=<result> with the update result (success, failed, rolled_back or rollback_failed)")
+	waitPIDFlag         = flag.Int("wait-pid", 0, "Wait for the process with this pid (like the app being updated) to exit before install")
+	waitTimeoutFlag     = flag.Duration("wait-timeout", 60*time.Second, "How long to wait for wait-pid to exit")
 	failFlag            = flag.Bool("fail", false, "Fail after install to test rollback")
 	stdoutFlag          = flag.Bool("stdout", false, "Log to stdout and to logfile")
 	urlFlag             = flag.String("url", "", "Url to the package")
 	hashFlag            = flag.String("hash", "", "Hash of the downloaded file to check")
 	showUIFlag          = flag.Bool("gui", false, "Show simple progress GUI")
+	strategyFlag        = flag.String("strategy", strategyInPlace, "Install strategy: inplace or swap")
+	layoutFlag          = flag.String("layout", layoutFlat, "Install layout: flat or versioned (<install-path>/versions/<version> and <install-path>/current symlink)")
+	versionFlag         = flag.String("version", "", "Version of the package for versioned layout (defaults to the manifest version or current timestamp)")
+	keepVersionsFlag    = flag.Int("keep-versions", 3, "How many versions to keep in versioned layout (0 to keep all)")
+	patternSyntaxFlag   = flag.String("pattern-syntax", syntaxRegexp, "Syntax of include/exclude patterns: regexp or glob (gitignore-like)")
+	filterOpsFlag       = flag.String("filter-ops", "remove", "Comma-separated operations include/exclude filters apply to: add,update,remove or all")
+	skipPreflightFlag   = flag.Bool("skip-preflight", false, "Skip disk space and permission checks before install")
+	jobsFlag            = flag.Int("jobs", runtime.NumCPU(), "Maximum number of files processed concurrently")
+	installJobsFlag     = flag.Int("install-jobs", 1, "Maximum number of files copied concurrently during install")
+	lockWaitFlag        = flag.Duration("lock-wait", 0, "How long to wait for another ministaller to release the install dir")
+	runningPolicyFlag   = flag.String("running-policy", runningPolicyIgnore, "What to do with processes using files in install dir: ignore, fail, wait, ask or kill")
+	runningTimeoutFlag  = flag.Duration("running-timeout", 30*time.Second, "How long to wait for processes using files in install dir to exit")
+	filtersFileFlag     = flag.String("filters-file", ".ministallerignore", "Name of gitignore-like file with exclude patterns in install dir or package")
+	noExtractFlag       = flag.Bool("no-extract", false, "Install straight from the zip archive without extracting it to a temporary dir")
+	streamFlag          = flag.Bool("stream", false, "Stream tar package from url installing files while it downloads (requires manifest-url and public-key)")
+	manifestURLFlag     = flag.String("manifest-url", "", "Url to the package manifest signed with ed25519 (signature is downloaded from <manifest-url>.sig)")
+	publicKeyFlag       = flag.String("public-key", "", "Base64-encoded ed25519 public key to verify the package manifest")
+	dryRunFlag          = flag.Bool("dry-run", false, "Only print what uninstall would remove and keep")
+	componentsFlag      = flag.String("components", "", "Comma-separated components to install (defaults to previously installed or default components)")
+	configFlag          = flag.String("config", "", "Path to .json, .yaml or .toml file with settings named as flags (flags and MINISTALLER_* environment variables override it)")
+	logFormatFlag       = flag.String("log-format", logFormatText, "Log records format: text, json or logfmt")
+	logLevelFlag        = flag.String("log-level", "debug", "Minimal level of logged messages: debug, info, warn or error")
+	runIDFlag           = flag.String("run-id", "", "Id added to structured log records of this run (generated if empty)")
+	reportFlag          = flag.String("report", "", "Path to JSON report with results of the run written when ministaller exits")
+	verifyFlag          = flag.Bool("verify", false, "Rehash added and updated files after install and roll back on mismatch")
+	healthExeFlag       = flag.String("health-exe", "", "Relative path to exe that should exit with 0 after install (or keep running with health-alive)")
+	healthAliveFlag     = flag.Duration("health-alive", 0, "How long health-exe should keep running instead of exiting")
+	healthURLFlag       = flag.String("health-url", "", "Url that should respond with 200 after install")
+	healthTimeoutFlag   = flag.Duration("health-timeout", 30*time.Second, "How long to wait for health-exe to exit or health-url to respond")
 )
 
 var (
 	currentExeFullPath string
+	command            = commandInstall
 )
 
 const (
 	appName            = "ministaller"
 	downloadRetryCount = 3
+	// ministaller's own files inside the install dir
+	DataDirName = "." + appName
+)
+
+const (
+	commandInstall   = "install"
+	commandUninstall = "uninstall"
+	commandHistory   = "history"
+)
+
+const (
+	strategyInPlace = "inplace"
+	strategySwap    = "swap"
+)
+
+const (
+	layoutFlat      = "flat"
+	layoutVersioned = "versioned"
 )
 
 func main() {
+	os.Exit(execute())
+}
+
+// execute runs the command and returns exit code
+// (deferred cleanup does not run after os.Exit)
+func execute() int {
 	err := parseFlags()
 	if err != nil {
-		flag.PrintDefaults()
-		log.Fatal(err.Error())
+		flag.Usage()
+		log.Println(err.Error())
+		return exitCode(err)
+	}
+
+	if command == commandHistory {
+		return runHistory()
+	}
+
+	// log file and install lock may create the install dir if it does not exist
+	createdRoot := topmostMissingDir(*installPathFlag)
+	failed := true
+
+	if len(createdRoot) > 0 {
+		// runs last, after the lock is released
+		defer func() {
+			if failed {
+				removeCreatedInstallDir(createdRoot)
+			}
+		}()
 	}
 
 	logfile, err := setupLogging()
@@ -67,56 +148,219 @@ func main() {
 	}
 
 	currentExeFullPath = executablePath()
-	log.Printf("Initialization. exe_path=%v", currentExeFullPath)
+	logFields(LevelInfo, "Initialization", "exe_path", currentExeFullPath)
 
-	pathToArchive := *packagePathFlag
+	installReport = NewInstallReport(command, *runIDFlag, *installPathFlag)
+
+	if *waitPIDFlag > 0 {
+		err = waitForProcess(*waitPIDFlag, *waitTimeoutFlag)
+		if err != nil {
+			logFields(LevelError, "Failed to wait for process", "error", err)
+			writeReport(err)
+			return exitCode(err)
+		}
+	}
+
+	installLock, err := AcquireInstallLock(*installPathFlag, *lockWaitFlag)
+	if err != nil {
+		logFields(LevelError, "Failed to acquire install lock", "error", err)
+		writeReport(err)
+		return exitCode(err)
+	}
+
+	if (command == commandInstall) && (len(*launchExeFlag) > 0) {
+		// runs when the lock is released and the report is finished
+		defer func() {
+			if lerr := launchApp(installReport.Status); lerr != nil {
+				logFields(LevelError, "Failed to launch exe", "error", lerr)
+			}
+		}()
+	}
+
+	if command == commandUninstall {
+		// runs after the lock is released
+		defer removeEmptyInstallDir(*installPathFlag)
+	}
+
+	defer installLock.Release()
+
+	// streamed package is downloaded and extracted during install
+	phases := []string{PhaseDiff, PhaseInstall}
+	if !*noExtractFlag && !*streamFlag {
+		phases = append([]string{PhaseExtract}, phases...)
+	}
+	if (len(*urlFlag) > 0) && !*streamFlag {
+		phases = append([]string{PhaseDownload}, phases...)
+	}
+
+	runCommand := run
+	if command == commandUninstall {
+		phases = []string{PhaseInstall}
+		runCommand = runUninstall
+	}
+
+	var progressHandler ProgressHandler = &LogProgressHandler{}
+	if *showUIFlag {
+		progressHandler = NewUIProgressHandler()
+	}
+
+	progressReporter := NewProgressReporter(progressHandler, phases...)
+	go progressReporter.handleProgress()
+
+	if *showUIFlag {
+		defer func() {
+			if r := recover(); r != nil {
+				guifinish()
+			}
+		}()
+
+		done := make(chan error, 1)
+
+		guiinit()
+		go func() {
+			done <- finishCommand(runCommand, progressReporter)
+		}()
+		guiloop()
+		err = <-done
+	} else {
+		err = finishCommand(runCommand, progressReporter)
+	}
+
+	writeReport(err)
+
+	if !*dryRunFlag {
+		if herr := AppendHistory(*installPathFlag, installReport.historyEntry()); herr != nil {
+			logFields(LevelError, "Failed to update install history", "error", herr)
+		}
+	}
+
+	failed = err != nil
+	if failed {
+		logFields(LevelError, "Finished with error", "command", command, "error", err, "exit_code", exitCode(err))
+	}
+
+	return exitCode(err)
+}
+
+// finishCommand makes sure progress handler is finished
+// even if the command failed before install started
+func finishCommand(runCommand func(*ProgressReporter) error, progressReporter *ProgressReporter) error {
+	err := runCommand(progressReporter)
+
+	// progress sent during download or hashing should be received
+	// before the channel is closed
+	progressReporter.waitProgressReported()
+	progressReporter.shutdown()
+	progressReporter.receiveFinish()
+
+	return err
+}
+
+// writeReport finishes the report and saves it if requested
+func writeReport(err error) {
+	installReport.finish(err)
+	if len(*reportFlag) == 0 {
+		return
+	}
+
+	if werr := installReport.Write(*reportFlag); werr != nil {
+		logFields(LevelError, "Failed to write report", "path", *reportFlag, "error", werr)
+	}
+}
+
+func runHistory() int {
+	entries, err := ReadHistory(*installPathFlag)
+	if err != nil {
+		log.Println(err.Error())
+		return exitCodeFailure
+	}
+
+	if len(entries) == 0 {
+		fmt.Println("No install history found")
+		return exitCodeSuccess
+	}
 
+	if err := printHistory(os.Stdout, entries); err != nil {
+		log.Println(err.Error())
+		return exitCodeFailure
+	}
+
+	return exitCodeSuccess
+}
+
+func run(progressReporter *ProgressReporter) error {
+	pathToArchive := *packagePathFlag
 	if len(*urlFlag) > 0 {
-		localPath, err := downloadFile(*urlFlag, downloadRetryCount)
+		installReport.setPackage(*urlFlag)
+	} else {
+		installReport.setPackage(pathToArchive)
+	}
+
+	if (len(*urlFlag) > 0) && !*streamFlag {
+		localPath, err := downloadFile(*urlFlag, downloadRetryCount, progressReporter)
 		if err != nil {
-			log.Fatal(err.Error())
+			return &DownloadError{URL: *urlFlag, Err: err}
 		}
 
 		defer os.Remove(localPath)
 
 		hash, err := calculateFileHash(localPath)
 		if err != nil {
-			log.Println(err.Error())
-		} else {
-			if hash != *hashFlag {
-				log.Printf("Hash mismatch! expected=%v found=%v", *hashFlag, hash)
-			} else {
-				log.Println("Download succeeded")
-				pathToArchive = localPath
-			}
+			return err
 		}
-	}
 
-	packageDirPath, err := ioutil.TempDir("", appName)
-	if err != nil {
-		log.Fatal(err)
+		if hash != *hashFlag {
+			log.Printf("Hash mismatch! expected=%v found=%v", *hashFlag, hash)
+			return &VerificationError{Err: fmt.Errorf("hash mismatch: expected %v, found %v", *hashFlag, hash)}
+		}
+
+		log.Println("Download succeeded")
+		pathToArchive = localPath
 	}
 
-	defer os.RemoveAll(packageDirPath)
+	if !*streamFlag {
+		if hash, err := calculateFileHash(pathToArchive); err == nil {
+			installReport.setPackageHash(hash)
+		}
+	}
 
-	err = Unzip(pathToArchive, packageDirPath)
+	pkg, err := openPackage(pathToArchive, progressReporter)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	packageDirPath = findUsefulDir(packageDirPath)
-	packageDirPath = filepath.ToSlash(packageDirPath)
-	log.Printf("Initialization. package_path=%v", packageDirPath)
+	defer pkg.Close()
+	logFields(LevelInfo, "Initialization", "package_path", pkg.Location())
 
 	installDirPath := filepath.ToSlash(*installPathFlag)
-	log.Printf("Initialization. install_path=%v", installDirPath)
+	logFields(LevelInfo, "Initialization", "install_path", installDirPath)
 
-	log.Printf("Initialization. exclude_filters=%v", excludePatternsFlag)
-	efilters := make([]*regexp.Regexp, 0, len(excludePatternsFlag))
-	for _, f := range excludePatternsFlag {
-		efilters = append(efilters, regexp.MustCompile(f))
+	// diff is generated against the real directory if install path is a symlink
+	diffDirPath := targetDir(installDirPath, *layoutFlag)
+	if realPath, err := filepath.EvalSymlinks(diffDirPath); err == nil {
+		diffDirPath = filepath.ToSlash(realPath)
 	}
 
+	filters, err := setupFilters(diffDirPath, pkg)
+	if err != nil {
+		return err
+	}
+	logFields(LevelInfo, "Initialization", "filters", filters)
+
+	state, components, err := setupComponents(installDirPath, pkg)
+	if err != nil {
+		return err
+	}
+	logFields(LevelInfo, "Initialization", "components", components)
+
+	permissions, err := setupPermissions(pkg)
+	if err != nil {
+		return err
+	}
+
+	freshInstall := isEmptyInstallDir(diffDirPath)
+	logFields(LevelInfo, "Initialization", "fresh_install", freshInstall)
+
 	df := &DiffGenerator{
 		filesToAdd:         make([]*UpdateFileInfo, 0),
 		filesToRemove:      make([]*UpdateFileInfo, 0),
@@ -127,66 +371,388 @@ func main() {
 		errors:             make(chan error, 1),
 		installDirHashes:   make(map[string]string),
 		packageDirHashes:   make(map[string]string),
-		installDirPath:     installDirPath,
-		packageDirPath:     packageDirPath,
-		exclude:            efilters,
+		installDirPath:     diffDirPath,
+		pkg:                pkg,
+		filters:            filters,
+		components:         components,
 		keepMissing:        *keepMissingFlag,
-		forceUpdate:        *forceUpdateFlag}
+		freshInstall:       freshInstall,
+		forceUpdate:        *forceUpdateFlag,
+		progressReporter:   progressReporter,
+		jobs:               NewLimiter(*jobsFlag)}
 
 	err = df.GenerateDiffs()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	progressReporter := &ProgressReporter{
-		progressChan:      make(chan int64),
-		systemMessageChan: make(chan string),
-		finished:          make(chan bool),
-		progressHandler:   &LogProgressHandler{},
+	rg := &RunningProcessesGuard{
+		installDir:       diffDirPath,
+		policy:           *runningPolicyFlag,
+		timeout:          *runningTimeoutFlag,
+		progressReporter: progressReporter,
 	}
 
-	if *showUIFlag {
-		progressReporter.progressHandler = NewUIProgressHandler()
+	// files held by running processes would fail preflight lock checks
+	err = rg.Ensure()
+	if err != nil {
+		logFields(LevelError, "Install aborted", "error", err)
+		return err
 	}
 
-	go progressReporter.handleProgress()
+	if !*skipPreflightFlag {
+		err = runPreflight(installDirPath, diffDirPath, df)
+		if err != nil {
+			return err
+		}
+	}
+
+	var installer Installer
+
+	var verifier *Verifier
+	if *verifyFlag {
+		verifier = NewVerifier(df, *jobsFlag)
+	}
+
+	var healthCheck *HealthCheck
+	if (len(*healthExeFlag) > 0) || (len(*healthURLFlag) > 0) {
+		healthCheck = &HealthCheck{
+			exe:              *healthExeFlag,
+			alive:            *healthAliveFlag,
+			url:              *healthURLFlag,
+			timeout:          *healthTimeoutFlag,
+			progressReporter: progressReporter,
+		}
+	}
+
+	if *layoutFlag == layoutVersioned {
+		vi := NewVersionedInstaller(installDirPath, pkg, state.Version, *keepVersionsFlag, progressReporter)
+		vi.failInTheEnd = *failFlag
+		vi.jobs = *installJobsFlag
+		vi.verifier = verifier
+		vi.healthCheck = healthCheck
+		vi.permissions = permissions
+		vi.freshInstall = freshInstall
+		installer = vi
+	} else if *strategyFlag == strategySwap {
+		installer = &SwapInstaller{
+			progressReporter: progressReporter,
+			installDir:       installDirPath,
+			pkg:              pkg,
+			verifier:         verifier,
+			healthCheck:      healthCheck,
+			permissions:      permissions,
+			freshInstall:     freshInstall,
+			jobs:             *installJobsFlag,
+			failInTheEnd:     *failFlag}
+	} else {
+		pi := &PackageInstaller{
+			backups:          make(map[string]string),
+			backupsChan:      make(chan BackupPair),
+			progressReporter: progressReporter,
+			installDir:       installDirPath,
+			pkg:              pkg,
+			verifier:         verifier,
+			healthCheck:      healthCheck,
+			permissions:      permissions,
+			freshInstall:     freshInstall,
+			jobs:             *installJobsFlag,
+			failInTheEnd:     *failFlag}
+
+		defer pi.removeSelfIfNeeded()
+		installer = pi
+	}
+
+	return doInstall(installer, df, state)
+}
+
+func runUninstall(progressReporter *ProgressReporter) error {
+	installDirPath := filepath.ToSlash(*installPathFlag)
+	logFields(LevelInfo, "Initialization", "install_path", installDirPath)
+
+	state, err := ReadInstallState(installDirPath)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return errors.New("nothing to uninstall: install state not found")
+	}
+	installReport.setVersions(state.Version, "")
+
+	filesDirPath := targetDir(installDirPath, state.Layout)
+	if realPath, err := filepath.EvalSymlinks(filesDirPath); err == nil {
+		filesDirPath = filepath.ToSlash(realPath)
+	}
+
+	filters, err := setupFilters(filesDirPath, nil)
+	if err != nil {
+		return err
+	}
+	logFields(LevelInfo, "Initialization", "filters", filters)
 
-	pi := &PackageInstaller{
-		backups:          make(map[string]string),
-		backupsChan:      make(chan BackupPair),
+	u := &Uninstaller{
 		progressReporter: progressReporter,
 		installDir:       installDirPath,
-		packageDir:       packageDirPath,
-		failInTheEnd:     *failFlag}
+		targetDir:        filesDirPath,
+		state:            state,
+		filters:          filters,
+		dryRun:           *dryRunFlag,
+		jobs:             *installJobsFlag,
+		failInTheEnd:     *failFlag,
+	}
 
-	defer pi.removeSelfIfNeeded()
+	err = u.Uninstall()
+	if err == nil {
+		log.Println("Uninstall succeeded")
+	} else {
+		logFields(LevelError, "Uninstall failed", "error", err)
+	}
 
-	if *showUIFlag {
-		defer func() {
-			if r := recover(); r != nil {
-				guifinish()
-			}
-		}()
+	return err
+}
 
-		guiinit()
-		go doInstall(pi, df)
-		guiloop()
+func doInstall(installer Installer, df *DiffGenerator, state *InstallState) error {
+	err := installer.Install(df)
+	if err != nil {
+		logFields(LevelError, "Install failed", "error", err)
+		return err
+	}
+
+	log.Println("Install succeeded")
+
+	installedDirPath := targetDir(filepath.ToSlash(*installPathFlag), *layoutFlag)
+
+	state.RecordFiles(installedDirPath, df)
+	if err := state.Write(*installPathFlag); err != nil {
+		logFields(LevelError, "Failed to save install state", "error", err)
+	}
+
+	return nil
+}
+
+// openPackage streams package with --stream, reads it straight
+// from the archive with --no-extract or extracts it into
+// a temporary dir removed on Close()
+func openPackage(pathToArchive string, progressReporter *ProgressReporter) (Package, error) {
+	if *streamFlag {
+		manifest, err := FetchSignedManifest(*manifestURLFlag, *publicKeyFlag)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewStreamPackage(*urlFlag, manifest, filepath.ToSlash(*installPathFlag), progressReporter)
+	}
+
+	if *noExtractFlag {
+		return NewZipPackage(pathToArchive)
+	}
+
+	tempDirPath, err := ioutil.TempDir("", appName)
+	if err != nil {
+		return nil, err
+	}
+
+	progressReporter.sendSystemMessage("Extracting the package...")
+	err = Unzip(pathToArchive, tempDirPath, progressReporter)
+	if err != nil {
+		os.RemoveAll(tempDirPath)
+		return nil, err
+	}
+
+	packageDirPath := filepath.ToSlash(findUsefulDir(tempDirPath))
+
+	dp, err := NewDirPackage(packageDirPath)
+	if err != nil {
+		os.RemoveAll(tempDirPath)
+		return nil, err
+	}
+
+	dp.tempDir = tempDirPath
+	return dp, nil
+}
+
+// setupComponents selects package components to install and
+// returns the new install state to save after successful install
+func setupComponents(installDirPath string, pkg Package) (*InstallState, *ComponentSet, error) {
+	previous, err := ReadInstallState(installDirPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	version, err := packageVersion(pkg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	state := &InstallState{Version: version, Layout: *layoutFlag}
+	if previous != nil {
+		state.Files = previous.Files
+	}
+
+	manifest := pkg.Manifest()
+	if manifest != nil {
+		state.UninstallHook = manifest.UninstallHook
+	}
+
+	if previous != nil {
+		installReport.setVersions(previous.Version, state.Version)
 	} else {
-		doInstall(pi, df)
+		installReport.setVersions("", state.Version)
 	}
+
+	if (manifest == nil) || (len(manifest.Components) == 0) {
+		if len(*componentsFlag) > 0 {
+			return nil, nil, flagError("components", "package does not declare any components")
+		}
+
+		return state, nil, nil
+	}
+
+	var requested []string
+
+	if len(*componentsFlag) > 0 {
+		requested = ParseComponents(*componentsFlag)
+	} else if (previous != nil) && (previous.Components != nil) {
+		// components removed from the package are silently dropped
+		requested = make([]string, 0)
+		for _, name := range previous.Components {
+			for _, c := range manifest.Components {
+				if c.Name == name {
+					requested = append(requested, name)
+				}
+			}
+		}
+	}
+
+	components, err := NewComponentSet(manifest.Components, requested)
+	if err != nil {
+		return nil, nil, flagError("components", "%v", err)
+	}
+
+	state.Components = components.Selected()
+
+	return state, components, nil
 }
 
-func doInstall(pi *PackageInstaller, df *DiffGenerator) {
-	err := pi.Install(df)
+func setupFilters(installDirPath string, pkg Package) (*PathFilter, error) {
+	ops, err := ParseFilterOps(*filterOpsFlag)
+	if err != nil {
+		return nil, err
+	}
+
+	filters, err := NewPathFilter(*patternSyntaxFlag, includePatternsFlag, excludePatternsFlag, ops)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(*filtersFileFlag) == 0 {
+		return filters, nil
+	}
+
+	err = filters.LoadFile(path.Join(installDirPath, *filtersFileFlag))
+	if (err != nil) && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if pkg == nil {
+		return filters, nil
+	}
 
+	rc, err := pkg.Open(*filtersFileFlag)
 	if err == nil {
-		log.Println("Install succeeded")
-		if len(*launchExeFlag) > 0 {
-			launchPostInstallExe()
+		defer rc.Close()
+		err = filters.Load(path.Join(pkg.Location(), *filtersFileFlag), rc)
+	}
+	if (err != nil) && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return filters, nil
+}
+
+func setupPermissions(pkg Package) (*PermissionSet, error) {
+	manifest := pkg.Manifest()
+	if manifest == nil {
+		return nil, nil
+	}
+
+	return NewPermissionSet(manifest.Permissions)
+}
+
+// isEmptyInstallDir returns true if dir does not exist or contains
+// nothing but ministaller's own files
+func isEmptyInstallDir(dir string) bool {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+
+	for _, e := range entries {
+		if e.Name() != DataDirName {
+			return false
+		}
+	}
+
+	return true
+}
+
+// topmostMissingDir returns the first of dir and its parents
+// that does not exist or empty string if dir exists
+func topmostMissingDir(dir string) string {
+	missing := ""
+
+	for current := filepath.Clean(dir); ; current = filepath.Dir(current) {
+		if _, err := os.Stat(current); !os.IsNotExist(err) {
+			break
+		}
+
+		missing = current
+
+		if filepath.Dir(current) == current {
+			break
 		}
+	}
+
+	return missing
+}
+
+// removeCreatedInstallDir rolls back fresh install into a dir created by this run
+func removeCreatedInstallDir(dir string) {
+	logFields(LevelInfo, "Removing install dir created by failed install", "path", dir)
+
+	err := os.RemoveAll(dir)
+	if err != nil {
+		logWarn("Error while removing %v: %v", dir, err)
+	}
+
+	// lock file of the created install dir is left next to it
+	os.Remove(lockFilePath(dir))
+}
+
+// targetDir returns dir with installed files for the layout
+func targetDir(installDirPath, layout string) string {
+	if layout == layoutVersioned {
+		return path.Join(installDirPath, CurrentLinkName)
+	}
+
+	return installDirPath
+}
+
+func runPreflight(installDirPath, diffDirPath string, filesProvider UpdateFilesProvider) error {
+	var pc *PreflightChecker
+
+	if *layoutFlag == layoutVersioned {
+		pc = NewPreflightChecker(path.Join(installDirPath, CurrentLinkName), path.Join(installDirPath, VersionsDirName, "new"))
+	} else if *strategyFlag == strategySwap {
+		pc = NewPreflightChecker(installDirPath, diffDirPath+StagingExt)
 	} else {
-		log.Printf("Install failed. err=%v", err)
+		pc = NewPreflightChecker(diffDirPath, "")
 	}
+
+	return pc.Check(filesProvider)
 }
 
 func findUsefulDir(initialDir string) string {
@@ -209,25 +775,107 @@ func findUsefulDir(initialDir string) string {
 	return currDir
 }
 
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %v [install|uninstall|history] [flags]\n", appName)
+	flag.PrintDefaults()
+	printExitCodes(flag.CommandLine.Output())
+}
+
 func parseFlags() error {
-	flag.Var(&excludePatternsFlag, "exclude", "Exclude pattern (can be specified multiple times)")
-	flag.Parse()
+	flag.Usage = usage
+	flag.Var(&excludePatternsFlag, "exclude", listFlagUsage("exclude", "Exclude pattern"))
+	flag.Var(&includePatternsFlag, "include", listFlagUsage("include", "Include pattern"))
+	flag.Var(&launchArgFlag, "launch-arg", listFlagUsage("launch-arg", "Argument for launch-exe"))
+	flag.Var(&launchEnvFlag, "launch-env", listFlagUsage("launch-env", "KEY=VALUE added to the environment of launch-exe"))
+	args := os.Args[1:]
+	if (len(args) > 0) && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
 
-	installFileInfo, err := os.Stat(*installPathFlag)
-	if os.IsNotExist(err) {
+	flag.CommandLine.Parse(args)
+
+	if (command != commandInstall) && (command != commandUninstall) && (command != commandHistory) {
+		return &ArgumentError{msg: fmt.Sprintf("unknown command: %v (should be install, uninstall or history)", command)}
+	}
+
+	err := applyConfig()
+	if err != nil {
 		return err
 	}
-	if !installFileInfo.IsDir() {
-		return errors.New("install-path does not point to a directory")
+
+	if (*strategyFlag != strategyInPlace) && (*strategyFlag != strategySwap) {
+		return flagError("strategy", "strategy should be either inplace or swap")
+	}
+
+	switch *runningPolicyFlag {
+	case runningPolicyIgnore, runningPolicyFail, runningPolicyWait, runningPolicyAsk, runningPolicyKill:
+	default:
+		return flagError("running-policy", "running-policy should be one of ignore, fail, wait, ask or kill")
+	}
+
+	if (*patternSyntaxFlag != syntaxGlob) && (*patternSyntaxFlag != syntaxRegexp) {
+		return flagError("pattern-syntax", "pattern-syntax should be either glob or regexp")
+	}
+
+	if _, err := ParseFilterOps(*filterOpsFlag); err != nil {
+		return flagError("filter-ops", "%v", err)
 	}
 
-	if len(*urlFlag) == 0 {
+	if (*layoutFlag != layoutFlat) && (*layoutFlag != layoutVersioned) {
+		return flagError("layout", "layout should be either flat or versioned")
+	}
+
+	if (*logFormatFlag != logFormatText) && (*logFormatFlag != logFormatJSON) && (*logFormatFlag != logFormatLogfmt) {
+		return flagError("log-format", "log-format should be one of text, json or logfmt")
+	}
+
+	if _, ok := parseLogLevel(*logLevelFlag); !ok {
+		return flagError("log-level", "log-level should be one of debug, info, warn or error")
+	}
+
+	if !isSafeVersion(*versionFlag) {
+		return flagError("version", "version should not contain path separators")
+	}
+
+	if len(*installPathFlag) == 0 {
+		return flagError("install-path", "install-path is required")
+	}
+
+	installFileInfo, err := os.Stat(*installPathFlag)
+	switch {
+	case os.IsNotExist(err) && (command == commandInstall):
+		// install creates missing install dir
+	case err != nil:
+		return flagError("install-path", "%v", err)
+	case !installFileInfo.IsDir():
+		return flagError("install-path", "install-path does not point to a directory")
+	}
+
+	if (*healthAliveFlag > 0) && (len(*healthExeFlag) == 0) {
+		return flagError("health-alive", "health-alive requires health-exe")
+	}
+
+	if (*waitPIDFlag > 0) && (*waitTimeoutFlag <= 0) {
+		return flagError("wait-timeout", "wait-timeout should be positive")
+	}
+
+	for _, env := range launchEnvFlag {
+		if !strings.Contains(env, "=") {
+			return flagError("launch-env", "launch-env should be KEY=VALUE, got %v", env)
+		}
+	}
+
+	if *streamFlag && ((len(*urlFlag) == 0) || (len(*manifestURLFlag) == 0) || (len(*publicKeyFlag) == 0)) {
+		return flagError("stream", "stream requires url, manifest-url and public-key")
+	}
+
+	if (command == commandInstall) && (len(*urlFlag) == 0) {
 		packageFileInfo, err := os.Stat(*packagePathFlag)
 		if os.IsNotExist(err) {
-			return err
+			return flagError("package-path", "%v", err)
 		}
 		if packageFileInfo.IsDir() {
-			return errors.New("package-path should point to a file")
+			return flagError("package-path", "package-path should point to a file")
 		}
 	}
 
@@ -242,31 +890,46 @@ func setupLogging() (f *os.File, err error) {
 		MaxAge:     28, //days
 	}
 
+	var out io.Writer = lgl
 	if *stdoutFlag {
-		mw := io.MultiWriter(os.Stdout, lgl)
-		log.SetOutput(mw)
-	} else {
-		log.SetOutput(lgl)
+		out = io.MultiWriter(os.Stdout, lgl)
+	}
+
+	if len(*runIDFlag) == 0 {
+		*runIDFlag = newRunID()
 	}
 
-	log.Println("------------------------------")
-	log.Println("Ministaller log started")
+	logWriter, err = NewLogWriter(out, *logFormatFlag, *logLevelFlag, *runIDFlag)
+	if err != nil {
+		return f, err
+	}
+
+	// log writer adds timestamps and levels itself
+	log.SetFlags(0)
+	log.SetOutput(logWriter)
+
+	if *logFormatFlag == logFormatText {
+		log.Println("------------------------------")
+	}
+	logFields(LevelInfo, "Ministaller log started", "run_id", *runIDFlag)
 
 	return f, err
 }
 
-func downloadFile(remoteAddr string, retryCount int) (string, error) {
+func downloadFile(remoteAddr string, retryCount int, pr *ProgressReporter) (string, error) {
 	triesCount := 0
 
 	for {
-		filepath, err := downloadFileOnce(remoteAddr)
+		filepath, err := downloadFileOnce(remoteAddr, pr)
 
 		if err != nil {
+			logFields(LevelError, "Download failed", "error", err)
 			triesCount++
 			if triesCount >= retryCount {
-				return "", nil
+				return "", err
 			} else {
 				log.Println("Retrying download...")
+				pr.sendSystemMessage(fmt.Sprintf("Retrying download (%v of %v)...", triesCount+1, retryCount))
 			}
 		} else {
 			return filepath, err
@@ -274,8 +937,8 @@ func downloadFile(remoteAddr string, retryCount int) (string, error) {
 	}
 }
 
-func downloadFileOnce(remoteAddr string) (filepath string, err error) {
-	log.Printf("Downloading file. addr=%v", remoteAddr)
+func downloadFileOnce(remoteAddr string, pr *ProgressReporter) (filepath string, err error) {
+	logFields(LevelInfo, "Downloading file", "addr", remoteAddr)
 
 	tempfile, err := ioutil.TempFile("", appName)
 	if err != nil {
@@ -283,26 +946,37 @@ func downloadFileOnce(remoteAddr string) (filepath string, err error) {
 	}
 	defer tempfile.Close()
 
-	resp, err := http.Get(remoteAddr)
-	defer resp.Body.Close()
+	defer func() {
+		if err != nil {
+			os.Remove(tempfile.Name())
+		}
+	}()
 
-	n, err := io.Copy(tempfile, resp.Body)
+	resp, err := http.Get(remoteAddr)
 	if err != nil {
 		return "", err
 	}
+	defer resp.Body.Close()
 
-	log.Printf("Downloaded file. bytes=%v", n)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected response status: %v", resp.Status)
+	}
 
-	return tempfile.Name(), nil
-}
+	var total uint64
+	if resp.ContentLength > 0 {
+		total = uint64(resp.ContentLength)
+	}
 
-func launchPostInstallExe() {
-	fullpath := path.Join(*installPathFlag, *launchExeFlag)
-	log.Printf("Trying to launch exe. path=%v", fullpath)
+	pr.startPhase(PhaseDownload, total)
+	pr.sendSystemMessage("Downloading the package...")
+	logFields(LevelInfo, "Download started", "bytes_total", resp.ContentLength)
 
-	cmd := exec.Command(fullpath, *launchArgsFlag)
-	err := cmd.Start()
+	n, err := io.Copy(tempfile, io.TeeReader(resp.Body, &ProgressWriter{pr}))
 	if err != nil {
-		log.Println(err)
+		return "", err
 	}
+
+	logFields(LevelInfo, "Downloaded file", "bytes", n)
+
+	return tempfile.Name(), nil
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// per-file debug messages would drown test output
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func TestFinishCommandReceivesPendingProgress(t *testing.T) {
+	pr := NewProgressReporter(&slowProgressHandler{}, PhaseDownload, PhaseDiff, PhaseInstall)
+	go pr.handleProgress()
+
+	expected := errors.New("download failed")
+	err := finishCommand(func(pr *ProgressReporter) error {
+		pr.startPhase(PhaseDownload, 100)
+		for i := 0; i < 100; i++ {
+			pr.accountBytes(1)
+		}
+
+		return expected
+	}, pr)
+
+	if err != expected {
+		t.Errorf("finishCommand returned %v, expected %v", err, expected)
+	}
+
+	if pr.currentProgress != 100 {
+		t.Errorf("%v bytes of progress were received, expected 100", pr.currentProgress)
+	}
+}
+
+// slowProgressHandler keeps progress sends pending for a while
+type slowProgressHandler struct {
+	LogProgressHandler
+}
+
+func (ph *slowProgressHandler) HandleProgress(current, total uint64) {
+	time.Sleep(time.Millisecond)
+}
+
+// runInstall runs install command with flags set by name and returns
+// its error after the report is finished and saved to install history
+func runInstall(t *testing.T, flags map[string]string) error {
+	for name, value := range flags {
+		f := flag.Lookup(name)
+		if f == nil {
+			t.Fatalf("unknown flag %v", name)
+		}
+
+		if err := f.Value.Set(value); err != nil {
+			t.Fatal(err)
+		}
+
+		defer f.Value.Set(f.DefValue)
+	}
+
+	installReport = NewInstallReport(commandInstall, "test", *installPathFlag)
+
+	pr := NewProgressReporter(&LogProgressHandler{}, PhaseDownload, PhaseExtract, PhaseDiff, PhaseInstall)
+	go pr.handleProgress()
+
+	err := finishCommand(run, pr)
+	installReport.finish(err)
+
+	if herr := AppendHistory(*installPathFlag, installReport.historyEntry()); herr != nil {
+		t.Error(herr)
+	}
+
+	return err
+}
+
+// writeTree creates files with content in root
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for relpath, content := range files {
+		fullpath := filepath.Join(root, filepath.FromSlash(relpath))
+		if err := os.MkdirAll(filepath.Dir(fullpath), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(fullpath, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkTree makes sure files in root have expected content
+func checkTree(t *testing.T, root string, files map[string]string) {
+	for relpath, expected := range files {
+		data, err := ioutil.ReadFile(filepath.Join(root, filepath.FromSlash(relpath)))
+		if err != nil {
+			t.Errorf("failed to read %v: %v", relpath, err)
+			continue
+		}
+
+		if string(data) != expected {
+			t.Errorf("%v contains %q, expected %q", relpath, data, expected)
+		}
+	}
+}
+
+// writePackage creates zip package with files and returns its path
+func writePackage(t *testing.T, dir string, files map[string]string) string {
+	packagePath := filepath.Join(dir, "package.zip")
+	f, err := os.Create(packagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zw := zip.NewWriter(f)
+	for relpath, content := range files {
+		header := &zip.FileHeader{Name: relpath, Method: zip.Deflate}
+		header.SetMode(0755)
+
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return packagePath
+}
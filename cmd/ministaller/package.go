@@ -0,0 +1,411 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	ManifestFileName = "ministaller.json"
+)
+
+// PackageManifest describes package contents and is stored
+// in the root of the package as ministaller.json
+type PackageManifest struct {
+	Version       string              `json:"version"`
+	Files         []*UpdateFileInfo   `json:"files"`
+	Components    []*PackageComponent `json:"components"`
+	UninstallHook string              `json:"uninstall_hook"` // relative path of executable run before uninstall
+	Permissions   []*PermissionRule   `json:"permissions"`
+}
+
+// Package provides files of the update
+type Package interface {
+	// Location is the path to the package dir or archive
+	Location() string
+	// Files returns all regular files by relative path
+	Files() map[string]*UpdateFileInfo
+	// Hashes returns sha1 of all files by relative path
+	Hashes(progress io.Writer, jobs Limiter) map[string]string
+	Manifest() *PackageManifest
+	Open(relpath string) (io.ReadCloser, error)
+	Mode(relpath string) os.FileMode
+	TotalSize() uint64
+	Close() error
+}
+
+// DirPackage is a package extracted into a directory
+type DirPackage struct {
+	root     string
+	tempDir  string
+	files    map[string]*UpdateFileInfo
+	manifest *PackageManifest
+}
+
+// ZipPackage reads files straight from the archive
+type ZipPackage struct {
+	archivePath string
+	reader      *zip.ReadCloser
+	prefix      string
+	entries     map[string]*zip.File
+	files       map[string]*UpdateFileInfo
+	manifest    *PackageManifest
+}
+
+func NewDirPackage(root string) (*DirPackage, error) {
+	dp := &DirPackage{
+		root:  root,
+		files: make(map[string]*UpdateFileInfo),
+	}
+
+	err := filepath.Walk(root, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() && isDataDir(root, fullpath) {
+			return filepath.SkipDir
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(root, fullpath)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(relativePath)
+
+		if relativePath == ManifestFileName {
+			return nil
+		}
+
+		dp.files[relativePath] = &UpdateFileInfo{
+			Filepath: relativePath,
+			FileSize: info.Size(),
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	dp.manifest, err = readManifest(dp.Open(ManifestFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	return dp, nil
+}
+
+func (dp *DirPackage) Location() string {
+	return dp.root
+}
+
+func (dp *DirPackage) Files() map[string]*UpdateFileInfo {
+	return dp.files
+}
+
+func (dp *DirPackage) Hashes(progress io.Writer, jobs Limiter) map[string]string {
+	hashes := CalculateHashes(dp.root, progress, jobs)
+	delete(hashes, ManifestFileName)
+	return hashes
+}
+
+func (dp *DirPackage) Manifest() *PackageManifest {
+	return dp.manifest
+}
+
+func (dp *DirPackage) Open(relpath string) (io.ReadCloser, error) {
+	return os.Open(path.Join(dp.root, relpath))
+}
+
+func (dp *DirPackage) Mode(relpath string) os.FileMode {
+	fi, err := os.Stat(path.Join(dp.root, relpath))
+	if err != nil {
+		return 0644
+	}
+
+	return fi.Mode()
+}
+
+func (dp *DirPackage) TotalSize() uint64 {
+	return totalSize(dp.files)
+}
+
+// Close removes temporary dir the package was extracted to
+func (dp *DirPackage) Close() error {
+	if len(dp.tempDir) == 0 {
+		return nil
+	}
+
+	return os.RemoveAll(dp.tempDir)
+}
+
+func NewZipPackage(archivePath string) (*ZipPackage, error) {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	zp := &ZipPackage{
+		archivePath: archivePath,
+		reader:      r,
+		prefix:      findZipPrefix(r.File),
+		entries:     make(map[string]*zip.File),
+		files:       make(map[string]*UpdateFileInfo),
+	}
+
+	logFields(LevelInfo, "Reading package from archive", "path", archivePath, "prefix", zp.prefix)
+
+	for _, f := range r.File {
+		if !f.Mode().IsRegular() || !strings.HasPrefix(f.Name, zp.prefix) {
+			continue
+		}
+
+		relativePath := strings.TrimPrefix(f.Name, zp.prefix)
+		if !isSafeRelativePath(relativePath) {
+			r.Close()
+			return nil, fmt.Errorf("unsafe path in archive: %v", f.Name)
+		}
+
+		if (relativePath == DataDirName) || strings.HasPrefix(relativePath, DataDirName+"/") {
+			continue
+		}
+
+		zp.entries[relativePath] = f
+
+		if relativePath == ManifestFileName {
+			continue
+		}
+
+		zp.files[relativePath] = &UpdateFileInfo{
+			Filepath: relativePath,
+			FileSize: int64(f.UncompressedSize64),
+		}
+	}
+
+	zp.manifest, err = readManifest(zp.Open(ManifestFileName))
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return zp, nil
+}
+
+func (zp *ZipPackage) Location() string {
+	return zp.archivePath
+}
+
+func (zp *ZipPackage) Files() map[string]*UpdateFileInfo {
+	return zp.files
+}
+
+// Hashes are taken from the manifest if available,
+// otherwise entries are hashed while streaming from the archive
+func (zp *ZipPackage) Hashes(progress io.Writer, jobs Limiter) map[string]string {
+	hashes := make(map[string]string)
+
+	if zp.manifest != nil {
+		log.Println("Using hashes from the package manifest")
+		for _, fi := range zp.manifest.Files {
+			hashes[fi.Filepath] = fi.Sha1
+		}
+
+		return hashes
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+
+	for relpath := range zp.files {
+		wg.Add(1)
+		jobs.Acquire()
+
+		go func(relpath string) {
+			defer wg.Done()
+			defer jobs.Release()
+
+			rc, err := zp.Open(relpath)
+			if err != nil {
+				logError("Error while calculating hash: %v", err)
+				return
+			}
+
+			defer rc.Close()
+
+			hash, err := calculateReaderHash(io.TeeReader(rc, progress))
+			if err != nil {
+				logError("Error while calculating hash: %v", err)
+				return
+			}
+
+			mutex.Lock()
+			hashes[relpath] = hash
+			mutex.Unlock()
+		}(relpath)
+	}
+
+	wg.Wait()
+	log.Printf("Hashes accounting finished")
+
+	return hashes
+}
+
+func (zp *ZipPackage) Manifest() *PackageManifest {
+	return zp.manifest
+}
+
+func (zp *ZipPackage) Open(relpath string) (io.ReadCloser, error) {
+	f, ok := zp.entries[relpath]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: relpath, Err: os.ErrNotExist}
+	}
+
+	return f.Open()
+}
+
+func (zp *ZipPackage) Mode(relpath string) os.FileMode {
+	f, ok := zp.entries[relpath]
+	if !ok || (f.Mode().Perm() == 0) {
+		return 0644
+	}
+
+	return f.Mode()
+}
+
+func (zp *ZipPackage) TotalSize() uint64 {
+	return totalSize(zp.files)
+}
+
+func (zp *ZipPackage) Close() error {
+	return zp.reader.Close()
+}
+
+// installFile copies file from the package to the destination
+func installFile(pkg Package, relpath, dst string) error {
+	logDebug("About to install file %v to %v", relpath, dst)
+
+	in, err := pkg.Open(relpath)
+	if err != nil {
+		logError("Failed to open source: %v", err)
+		return err
+	}
+
+	defer in.Close()
+
+	return writeFile(dst, pkg.Mode(relpath), in)
+}
+
+func readManifest(rc io.ReadCloser, err error) (*PackageManifest, error) {
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseManifest(data)
+}
+
+func parseManifest(data []byte) (*PackageManifest, error) {
+	manifest := &PackageManifest{}
+	err := json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid package manifest: %v", err)
+	}
+
+	for _, fi := range manifest.Files {
+		if !isSafeRelativePath(fi.Filepath) {
+			return nil, errors.New("unsafe path in package manifest: " + fi.Filepath)
+		}
+	}
+
+	logFields(LevelInfo, "Package manifest found", "version", manifest.Version, "files", len(manifest.Files))
+
+	return manifest, nil
+}
+
+// findZipPrefix finds chain of single top-level directories
+// like findUsefulDir() does for the extracted package
+func findZipPrefix(files []*zip.File) string {
+	prefix := ""
+
+	for {
+		var next string
+		single := true
+
+		for _, f := range files {
+			if !strings.HasPrefix(f.Name, prefix) || (f.Name == prefix) {
+				continue
+			}
+
+			rest := strings.TrimPrefix(f.Name, prefix)
+			slash := strings.Index(rest, "/")
+			if slash == -1 {
+				// file in the current dir
+				single = false
+				break
+			}
+
+			top := rest[:slash+1]
+			if len(next) == 0 {
+				next = top
+			} else if next != top {
+				single = false
+				break
+			}
+		}
+
+		if !single || (len(next) == 0) {
+			return prefix
+		}
+
+		prefix += next
+	}
+}
+
+func isSafeRelativePath(relpath string) bool {
+	if (len(relpath) == 0) || path.IsAbs(relpath) || strings.Contains(relpath, "\\") {
+		return false
+	}
+
+	for _, part := range strings.Split(relpath, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+func totalSize(files map[string]*UpdateFileInfo) uint64 {
+	var total uint64
+	for _, fi := range files {
+		total += uint64(fi.FileSize)
+	}
+
+	return total
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+)
+
+const (
+	rootPermissionPath = "."
+)
+
+// PermissionRule sets mode and ownership of installed files and dirs
+type PermissionRule struct {
+	Path  string `json:"path"`  // gitignore-like glob or "." for install dir itself
+	Mode  string `json:"mode"`  // octal like "0755"
+	Owner string `json:"owner"` // user name or uid
+	Group string `json:"group"` // group name or gid
+}
+
+type permission struct {
+	pattern string
+	re      *regexp.Regexp
+	mode    os.FileMode
+	hasMode bool
+	uid     int
+	gid     int
+}
+
+// PermissionSet applies manifest permission rules
+// where the last matching rule wins for each attribute
+type PermissionSet struct {
+	rules []*permission
+}
+
+func NewPermissionSet(rules []*PermissionRule) (*PermissionSet, error) {
+	ps := &PermissionSet{}
+
+	for _, r := range rules {
+		p := &permission{pattern: r.Path, uid: -1, gid: -1}
+
+		if r.Path != rootPermissionPath {
+			expr, err := globToRegexp(r.Path)
+			if err != nil {
+				return nil, fmt.Errorf("permissions: invalid path %q: %v", r.Path, err)
+			}
+			p.re = regexp.MustCompile(expr)
+		}
+
+		if len(r.Mode) > 0 {
+			mode, err := strconv.ParseUint(r.Mode, 8, 32)
+			if (err != nil) || (mode > 07777) {
+				return nil, fmt.Errorf("permissions: %v: invalid mode %q", r.Path, r.Mode)
+			}
+			p.mode, p.hasMode = os.FileMode(mode), true
+		}
+
+		if len(r.Owner) > 0 {
+			uid, err := lookupID(r.Owner, func(name string) (string, error) {
+				u, err := user.Lookup(name)
+				if err != nil {
+					return "", err
+				}
+				return u.Uid, nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("permissions: %v: unknown owner %q: %v", r.Path, r.Owner, err)
+			}
+			p.uid = uid
+		}
+
+		if len(r.Group) > 0 {
+			gid, err := lookupID(r.Group, func(name string) (string, error) {
+				g, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return g.Gid, nil
+			})
+			if err != nil {
+				return nil, fmt.Errorf("permissions: %v: unknown group %q: %v", r.Path, r.Group, err)
+			}
+			p.gid = gid
+		}
+
+		ps.rules = append(ps.rules, p)
+	}
+
+	return ps, nil
+}
+
+// Apply sets permissions of relpaths inside root; if withDirs is set
+// the root and all its directories are updated as well
+func (ps *PermissionSet) Apply(root string, relpaths []string, withDirs bool) error {
+	if (ps == nil) || (len(ps.rules) == 0) {
+		return nil
+	}
+
+	logFields(LevelInfo, "Applying permissions", "root", root, "files", len(relpaths), "dirs", withDirs)
+
+	for _, relpath := range relpaths {
+		if err := ps.applyOne(root, relpath, false); err != nil {
+			return err
+		}
+	}
+
+	if !withDirs {
+		return nil
+	}
+
+	// ownership and mode of the dirs are applied after the files
+	// so that restrictive dir modes do not get in the way
+	return filepath.Walk(root, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if isDataDir(root, fullpath) {
+			return filepath.SkipDir
+		}
+
+		relpath, err := filepath.Rel(root, fullpath)
+		if err != nil {
+			return err
+		}
+
+		return ps.applyOne(root, filepath.ToSlash(relpath), true)
+	})
+}
+
+// changedFiles returns relative paths of added and updated files
+func changedFiles(filesProvider UpdateFilesProvider) []string {
+	changed := make([]string, 0, len(filesProvider.FilesToAdd())+len(filesProvider.FilesToUpdate()))
+	for _, fi := range append(filesProvider.FilesToAdd(), filesProvider.FilesToUpdate()...) {
+		changed = append(changed, fi.Filepath)
+	}
+
+	return changed
+}
+
+func (ps *PermissionSet) applyOne(root, relpath string, isDir bool) error {
+	mode, hasMode := os.FileMode(0), false
+	uid, gid := -1, -1
+
+	for _, p := range ps.rules {
+		if !p.matches(relpath, isDir) {
+			continue
+		}
+
+		if p.hasMode {
+			mode, hasMode = p.mode, true
+		}
+		if p.uid != -1 {
+			uid = p.uid
+		}
+		if p.gid != -1 {
+			gid = p.gid
+		}
+	}
+
+	fullpath := path.Join(root, relpath)
+
+	if (uid != -1) || (gid != -1) {
+		logFields(LevelInfo, "Changing owner", "path", relpath, "uid", uid, "gid", gid)
+		if err := os.Lchown(fullpath, uid, gid); err != nil {
+			return err
+		}
+	}
+
+	if hasMode {
+		logFields(LevelInfo, "Changing mode", "path", relpath, "mode", mode)
+		if err := os.Chmod(fullpath, mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *permission) matches(relpath string, isDir bool) bool {
+	if p.re == nil {
+		return relpath == rootPermissionPath
+	}
+
+	if relpath == rootPermissionPath {
+		return false
+	}
+
+	// dir-only patterns like "bin/" should match the dir itself
+	if isDir {
+		relpath += "/"
+	}
+
+	return p.re.MatchString(relpath)
+}
+
+func lookupID(nameOrID string, lookup func(name string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(nameOrID); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(nameOrID)
+	if err != nil {
+		return -1, err
+	}
+
+	return strconv.Atoi(id)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+// PreflightError lists everything that would break the install
+type PreflightError struct {
+	Problems []string
+}
+
+func (pe *PreflightError) Error() string {
+	return fmt.Sprintf("preflight checks failed (%v problems): %v", len(pe.Problems), strings.Join(pe.Problems, "; "))
+}
+
+// PreflightChecker verifies that install can succeed before any change is made:
+// free disk space per filesystem, write permissions and locked files
+type PreflightChecker struct {
+	installDir string
+	// files are written into staging dir instead of install dir (swap strategies)
+	stagingDir string
+	problems   []string
+	// required bytes per filesystem
+	required    map[string]uint64
+	fsDirs      map[string]string
+	checkedDirs map[string]bool
+}
+
+func NewPreflightChecker(installDir, stagingDir string) *PreflightChecker {
+	return &PreflightChecker{
+		installDir:  installDir,
+		stagingDir:  stagingDir,
+		problems:    make([]string, 0),
+		required:    make(map[string]uint64),
+		fsDirs:      make(map[string]string),
+		checkedDirs: make(map[string]bool),
+	}
+}
+
+func (pc *PreflightChecker) Check(filesProvider UpdateFilesProvider) error {
+	log.Println("Running preflight checks...")
+
+	if len(pc.stagingDir) > 0 {
+		pc.checkStaging(filesProvider)
+	} else {
+		pc.checkInPlace(filesProvider)
+	}
+
+	pc.checkFreeSpace()
+
+	if len(pc.problems) > 0 {
+		logFields(LevelError, "Preflight checks failed", "problems", len(pc.problems))
+		for _, p := range pc.problems {
+			log.Printf("Preflight problem: %v", p)
+		}
+
+		return &PreflightError{Problems: pc.problems}
+	}
+
+	log.Println("Preflight checks passed")
+	return nil
+}
+
+func (pc *PreflightChecker) checkInPlace(filesProvider UpdateFilesProvider) {
+	for _, fi := range filesProvider.FilesToRemove() {
+		pc.checkExistingFile(path.Join(pc.installDir, fi.Filepath))
+	}
+
+	// backups are renamed in the same directory so they don't need
+	// extra space, but old content stays on disk until the very end
+	for _, fi := range filesProvider.FilesToUpdate() {
+		fullpath := path.Join(pc.installDir, fi.Filepath)
+		pc.checkExistingFile(fullpath)
+		pc.require(fullpath, fi.FileSize)
+	}
+
+	for _, fi := range filesProvider.FilesToAdd() {
+		fullpath := path.Join(pc.installDir, fi.Filepath)
+		pc.checkDirWritable(nearestExistingDir(path.Dir(fullpath)))
+		pc.require(fullpath, fi.FileSize)
+	}
+}
+
+func (pc *PreflightChecker) checkStaging(filesProvider UpdateFilesProvider) {
+	// install dir is renamed or the symlink is replaced
+	pc.checkDirWritable(nearestExistingDir(path.Dir(pc.installDir)))
+	pc.checkDirWritable(nearestExistingDir(pc.stagingDir))
+
+	// unchanged files are hardlinked so only new content takes space
+	for _, fi := range filesProvider.FilesToUpdate() {
+		pc.require(pc.stagingDir, fi.FileSize)
+	}
+
+	for _, fi := range filesProvider.FilesToAdd() {
+		pc.require(pc.stagingDir, fi.FileSize)
+	}
+}
+
+func (pc *PreflightChecker) checkExistingFile(fullpath string) {
+	pc.checkDirWritable(path.Dir(fullpath))
+
+	if !isFileWritable(fullpath) {
+		pc.addProblem("file is not writable: %v", fullpath)
+	} else if isCurrentExe(fullpath) {
+		// running installer is replaced by renaming during self-update
+		logFields(LevelInfo, "Skipping lock check of the running installer", "path", fullpath)
+	} else if isFileLocked(fullpath) {
+		pc.addProblem("file is locked by another process: %v", fullpath)
+	}
+}
+
+func isCurrentExe(fullpath string) bool {
+	if len(currentExeFullPath) == 0 {
+		return false
+	}
+
+	fi, err := os.Stat(fullpath)
+	if err != nil {
+		return false
+	}
+
+	exeInfo, err := os.Stat(currentExeFullPath)
+	if err != nil {
+		return false
+	}
+
+	return os.SameFile(fi, exeInfo)
+}
+
+func (pc *PreflightChecker) checkDirWritable(dirpath string) {
+	if pc.checkedDirs[dirpath] {
+		return
+	}
+	pc.checkedDirs[dirpath] = true
+
+	f, err := ioutil.TempFile(dirpath, appName)
+	if err != nil {
+		pc.addProblem("directory is not writable: %v (%v)", dirpath, err)
+		return
+	}
+
+	f.Close()
+	os.Remove(f.Name())
+}
+
+func (pc *PreflightChecker) require(fullpath string, size int64) {
+	dirpath := nearestExistingDir(path.Dir(fullpath))
+
+	fsid, err := fileSystemID(dirpath)
+	if err != nil {
+		pc.addProblem("cannot determine filesystem of %v: %v", dirpath, err)
+		return
+	}
+
+	if _, ok := pc.fsDirs[fsid]; !ok {
+		pc.fsDirs[fsid] = dirpath
+	}
+
+	pc.required[fsid] += uint64(size)
+}
+
+func (pc *PreflightChecker) checkFreeSpace() {
+	for fsid, required := range pc.required {
+		dirpath := pc.fsDirs[fsid]
+
+		available, err := diskFreeSpace(dirpath)
+		if err != nil {
+			pc.addProblem("cannot determine free space for %v: %v", dirpath, err)
+			continue
+		}
+
+		logFields(LevelInfo, "Disk space", "path", dirpath, "required", required, "available", available)
+
+		if available < required {
+			pc.addProblem("not enough disk space for %v: required=%v available=%v", dirpath, required, available)
+		}
+	}
+}
+
+func (pc *PreflightChecker) addProblem(format string, v ...interface{}) {
+	pc.problems = append(pc.problems, fmt.Sprintf(format, v...))
+}
+
+func nearestExistingDir(dirpath string) string {
+	for {
+		if fi, err := os.Stat(dirpath); err == nil && fi.IsDir() {
+			return dirpath
+		}
+
+		parent := path.Dir(dirpath)
+		if parent == dirpath {
+			return dirpath
+		}
+		dirpath = parent
+	}
+}
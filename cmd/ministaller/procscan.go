@@ -0,0 +1,171 @@
+// +build !windows
+
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	procRoot = "/proc"
+)
+
+// findProcessesUsing scans /proc for processes that have their executable,
+// mapped libraries or open files under the dir
+func findProcessesUsing(dir string) ([]RunningProcess, error) {
+	absdir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if realdir, err := filepath.EvalSymlinks(absdir); err == nil {
+		absdir = realdir
+	}
+
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		// no procfs on this system
+		return nil, nil
+	}
+
+	selfPid := os.Getpid()
+	processes := make([]RunningProcess, 0)
+
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if (err != nil) || (pid == selfPid) {
+			continue
+		}
+
+		pidDir := filepath.Join(procRoot, e.Name())
+		if usedPath, ok := findUsedPath(pidDir, absdir); ok {
+			processes = append(processes, RunningProcess{
+				PID:  pid,
+				Name: processName(pidDir),
+				Path: usedPath,
+			})
+		}
+	}
+
+	return processes, nil
+}
+
+func findUsedPath(pidDir, dir string) (string, bool) {
+	if exe, err := os.Readlink(filepath.Join(pidDir, "exe")); err == nil && isUsedPath(exe, dir) {
+		return exe, true
+	}
+
+	if mapped, ok := findMappedPath(filepath.Join(pidDir, "maps"), dir); ok {
+		return mapped, true
+	}
+
+	fdDir := filepath.Join(pidDir, "fd")
+	fds, err := ioutil.ReadDir(fdDir)
+	if err != nil {
+		return "", false
+	}
+
+	for _, fd := range fds {
+		target, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+		if err == nil && isUsedPath(target, dir) {
+			return target, true
+		}
+	}
+
+	return "", false
+}
+
+func findMappedPath(mapsPath, dir string) (string, bool) {
+	f, err := os.Open(mapsPath)
+	if err != nil {
+		return "", false
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// address perms offset dev inode pathname
+		fields := strings.SplitN(scanner.Text(), " ", 6)
+		if len(fields) < 6 {
+			continue
+		}
+
+		mapped := strings.TrimSpace(fields[5])
+		mapped = strings.TrimSuffix(mapped, " (deleted)")
+
+		if isUsedPath(mapped, dir) {
+			return mapped, true
+		}
+	}
+
+	return "", false
+}
+
+func processName(pidDir string) string {
+	comm, err := ioutil.ReadFile(filepath.Join(pidDir, "comm"))
+	if err != nil {
+		return filepath.Base(pidDir)
+	}
+
+	return strings.TrimSpace(string(comm))
+}
+
+// isUsedPath checks if p is a file of the installation; files in the data
+// dir (like install lock held by another waiting ministaller) are not
+func isUsedPath(p, dir string) bool {
+	return isPathUnder(p, dir) && !isPathUnder(p, dir+"/"+DataDirName)
+}
+
+func isPathUnder(p, dir string) bool {
+	p = strings.TrimSuffix(p, " (deleted)")
+	return (p == dir) || strings.HasPrefix(p, dir+"/")
+}
+
+func isProcessAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return (err == nil) || (err == syscall.EPERM)
+}
+
+// terminateProcess asks process to exit and kills it after timeout
+func terminateProcess(pid int, timeout time.Duration) error {
+	err := syscall.Kill(pid, syscall.SIGTERM)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !isProcessAlive(pid) {
+			return nil
+		}
+
+		time.Sleep(processPollInterval)
+	}
+
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
+
+// setProcessGroup makes the process leader of its own group
+// so that killProcessGroup stops its children as well
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// setDetached starts the process in a new session so that it
+// keeps running after ministaller and its terminal are gone
+func setDetached(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
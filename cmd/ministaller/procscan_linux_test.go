@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsUsedPath(t *testing.T) {
+	tests := []struct {
+		path string
+		used bool
+	}{
+		{"/opt/app/app.bin", true},
+		{"/opt/app/lib/libapp.so (deleted)", true},
+		{"/opt/app", true},
+		{"/opt/app/" + DataDirName + "/history.jsonl", false},
+		{"/opt/app/" + DataDirName, false},
+		{"/opt/app/lib/" + DataDirName + "/file", true},
+		{"/opt/application/app.bin", false},
+	}
+
+	for _, tt := range tests {
+		if got := isUsedPath(tt.path, "/opt/app"); got != tt.used {
+			t.Errorf("isUsedPath(%q) = %v, expected %v", tt.path, got, tt.used)
+		}
+	}
+}
+
+func TestFindProcessesUsingSkipsDataDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "procscan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if realDir, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = realDir
+	}
+
+	dataPath := filepath.Join(dir, DataDirName, HistoryFileName)
+	if err := os.MkdirAll(filepath.Dir(dataPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dataPath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	filePath := filepath.Join(dir, "app.dat")
+	if err := ioutil.WriteFile(filePath, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dataHolder := startHolding(t, dataPath)
+	fileHolder := startHolding(t, filePath)
+
+	processes, err := findProcessesUsing(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	foundFileHolder := false
+	for _, p := range processes {
+		if p.PID == dataHolder {
+			t.Errorf("process holding data dir file should be skipped: %v", p.Path)
+		}
+		if p.PID == fileHolder {
+			foundFileHolder = true
+		}
+	}
+
+	if !foundFileHolder {
+		t.Errorf("process holding %v was not found", filePath)
+	}
+}
+
+// startHolding starts a process keeping the file open as its stdin
+func startHolding(t *testing.T, fullpath string) int {
+	f, err := os.Open(fullpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command("sleep", "30")
+	cmd.Stdin = f
+	if err := cmd.Start(); err != nil {
+		t.Skipf("cannot start sleep: %v", err)
+	}
+
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	return cmd.Process.Pid
+}
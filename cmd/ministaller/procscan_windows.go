@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const (
+	processQueryLimitedInformation = 0x1000
+	stillActive                    = 259
+	detachedProcess                = 0x00000008
+)
+
+func findProcessesUsing(dir string) ([]RunningProcess, error) {
+	// locked files are reported by preflight checks instead
+	log.Println("Looking for running processes is not supported on Windows")
+	return nil, nil
+}
+
+func terminateProcess(pid int, timeout time.Duration) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	return p.Kill()
+}
+
+func isProcessAlive(pid int) bool {
+	h, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+
+	defer syscall.CloseHandle(h)
+
+	var exitCode uint32
+	err = syscall.GetExitCodeProcess(h, &exitCode)
+	return (err == nil) && (exitCode == stillActive)
+}
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// killProcessGroup kills only the process itself on Windows
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// setDetached starts the process without ministaller's console
+func setDetached(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: detachedProcess | syscall.CREATE_NEW_PROCESS_GROUP}
+}
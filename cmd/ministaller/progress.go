@@ -0,0 +1,290 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+type ProgressHandler interface {
+	HandleSystemMessage(message string)
+	HandlePhaseChange(phase string)
+	HandlePercentChange(percent int)
+	HandleProgress(current, total uint64)
+	HandleFileChange(relpath string)
+	HandleConfirmation(question string) bool
+	HandleFinish()
+}
+
+type LogProgressHandler struct {
+}
+
+const (
+	PhaseDownload = "download"
+	PhaseExtract  = "extract"
+	PhaseDiff     = "diff"
+	PhaseInstall  = "install"
+)
+
+// share of each phase in the overall progress
+var phaseWeights = map[string]uint64{
+	PhaseDownload: 40,
+	PhaseExtract:  15,
+	PhaseDiff:     15,
+	PhaseInstall:  30,
+}
+
+type ProgressReporter struct {
+	grandTotal        uint64 // total of the current phase
+	currentProgress   uint64 // progress of the current phase
+	progressChan      chan int64
+	progressWG        sync.WaitGroup
+	percent           int //0..100 overall
+	phase             string
+	phases            []string
+	completedWeight   uint64
+	totalWeight       uint64
+	systemMessageChan chan string
+	fileChan          chan string
+	finished          chan bool
+	shutdownOnce      sync.Once
+	finishOnce        sync.Once
+	progressHandler   ProgressHandler
+}
+
+// ProgressWriter accounts everything written as progress of the current phase
+type ProgressWriter struct {
+	pr *ProgressReporter
+}
+
+func NewProgressReporter(progressHandler ProgressHandler, phases ...string) *ProgressReporter {
+	pr := &ProgressReporter{
+		progressChan:      make(chan int64),
+		phases:            phases,
+		systemMessageChan: make(chan string),
+		fileChan:          make(chan string),
+		finished:          make(chan bool),
+		progressHandler:   progressHandler,
+	}
+
+	for _, phase := range phases {
+		pr.totalWeight += phaseWeights[phase]
+	}
+
+	return pr
+}
+
+func (pw *ProgressWriter) Write(p []byte) (int, error) {
+	pw.pr.accountBytes(int64(len(p)))
+	return len(p), nil
+}
+
+func (pr *ProgressReporter) accountRemove(progress int64) {
+	pr.progressWG.Add(1)
+	go func() {
+		pr.progressChan <- (progress * RemoveFactor) / 100
+	}()
+}
+
+func (pr *ProgressReporter) accountUpdate(progress int64) {
+	pr.progressWG.Add(1)
+	go func() {
+		pr.progressChan <- (progress * UpdateFactor) / 100
+	}()
+}
+
+func (pr *ProgressReporter) accountAdd(progress int64) {
+	pr.progressWG.Add(1)
+	go func() {
+		pr.progressChan <- (progress * AddFactor) / 100
+	}()
+}
+
+func (pr *ProgressReporter) accountBackupRemove() {
+	// exact size of files is not known when removeBackups()
+	// so using some arbitrary value (fair dice roll)
+	pr.progressWG.Add(1)
+	go func() {
+		pr.progressChan <- RemoveBackupPrice
+	}()
+}
+
+func (pr *ProgressReporter) accountLink() {
+	// hardlinking does not depend on the file size
+	pr.progressWG.Add(1)
+	go func() {
+		pr.progressChan <- LinkPrice
+	}()
+}
+
+func (pr *ProgressReporter) accountBytes(progress int64) {
+	pr.progressWG.Add(1)
+	go func() {
+		pr.progressChan <- progress
+	}()
+}
+
+// startPhase switches reporting to the next phase (or restarts current one)
+// after all progress of the previous phase is accounted
+func (pr *ProgressReporter) startPhase(phase string, total uint64) {
+	pr.waitProgressReported()
+
+	if phase != pr.phase {
+		pr.completedWeight += pr.phaseWeight(pr.phase)
+		pr.phase = phase
+		logWriter.setPhase(phase)
+		logFields(LevelInfo, "Progress phase started", "phase", phase, "total", total)
+		pr.progressHandler.HandlePhaseChange(phase)
+	}
+
+	pr.grandTotal = total
+	pr.currentProgress = 0
+
+	pr.reportPercent()
+}
+
+func (pr *ProgressReporter) phaseWeight(phase string) uint64 {
+	for _, p := range pr.phases {
+		if p == phase {
+			return phaseWeights[phase]
+		}
+	}
+
+	return 0
+}
+
+func (pr *ProgressReporter) overallPercent() int {
+	if pr.totalWeight == 0 {
+		return 0
+	}
+
+	progress := pr.completedWeight * 100
+
+	if pr.grandTotal > 0 {
+		current := pr.currentProgress
+		// backups removal price is not exact
+		if current > pr.grandTotal {
+			current = pr.grandTotal
+		}
+
+		progress += (pr.phaseWeight(pr.phase) * 100 * current) / pr.grandTotal
+	}
+
+	percent := progress / pr.totalWeight
+	if percent > 100 {
+		percent = 100
+	}
+
+	return int(percent)
+}
+
+func (pr *ProgressReporter) reportPercent() {
+	// overall progress never goes back even if phase is restarted
+	percent := pr.overallPercent()
+	if percent > pr.percent {
+		pr.percent = percent
+		pr.progressHandler.HandlePercentChange(pr.percent)
+	}
+}
+
+func (pr *ProgressReporter) reportingLoop() {
+	for chunk := range pr.progressChan {
+		pr.currentProgress += uint64(chunk)
+
+		pr.reportPercent()
+		pr.progressHandler.HandleProgress(pr.currentProgress, pr.grandTotal)
+
+		pr.progressWG.Done()
+	}
+
+	log.Println("Reporting loop finished")
+}
+
+func (pr *ProgressReporter) waitProgressReported() {
+	log.Println("Waiting for progress reporting to finish")
+	pr.progressWG.Wait()
+}
+
+// shutdown can be called more than once (e.g. after early failure)
+func (pr *ProgressReporter) shutdown() {
+	pr.shutdownOnce.Do(func() {
+		log.Println("Shutting down progress reporter...")
+		close(pr.progressChan)
+		go func() {
+			pr.finished <- true
+		}()
+	})
+}
+
+func (pr *ProgressReporter) sendSystemMessage(msg string) {
+	pr.systemMessageChan <- msg
+}
+
+func (pr *ProgressReporter) sendCurrentFile(relpath string) {
+	pr.fileChan <- relpath
+}
+
+func (pr *ProgressReporter) receiveSystemMessages() {
+	for msg := range pr.systemMessageChan {
+		pr.progressHandler.HandleSystemMessage(msg)
+	}
+
+	log.Println("System messages handling finished")
+}
+
+func (pr *ProgressReporter) receiveFileChanges() {
+	for relpath := range pr.fileChan {
+		pr.progressHandler.HandleFileChange(relpath)
+	}
+
+	log.Println("File changes handling finished")
+}
+
+func (pr *ProgressReporter) askConfirmation(question string) bool {
+	log.Printf("Asking confirmation: %v", question)
+	answer := pr.progressHandler.HandleConfirmation(question)
+	log.Printf("Confirmation answer: %v", answer)
+	return answer
+}
+
+func (pr *ProgressReporter) receiveFinish() {
+	pr.finishOnce.Do(func() {
+		log.Println("Waiting for teardown and global finish...")
+		<-pr.finished
+		pr.progressHandler.HandleFinish()
+	})
+}
+
+func (pr *ProgressReporter) handleProgress() {
+	go pr.reportingLoop()
+	go pr.receiveSystemMessages()
+	go pr.receiveFileChanges()
+}
+
+func (ph *LogProgressHandler) HandlePercentChange(percent int) {
+	log.Printf("Completed %v%%", percent)
+}
+
+func (ph *LogProgressHandler) HandleSystemMessage(msg string) {
+	log.Printf("System message: %v", msg)
+}
+
+func (ph *LogProgressHandler) HandlePhaseChange(phase string) {
+	log.Printf("Phase: %v", phase)
+}
+
+func (ph *LogProgressHandler) HandleProgress(current, total uint64) {
+	// percent changes are logged instead
+}
+
+func (ph *LogProgressHandler) HandleFileChange(relpath string) {
+	// every file operation is logged by the installer anyway
+}
+
+func (ph *LogProgressHandler) HandleConfirmation(question string) bool {
+	// there is nobody to ask
+	return false
+}
+
+func (ph *LogProgressHandler) HandleFinish() {
+	log.Println("Finished")
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	opAdd     = "add"
+	opUpdate  = "update"
+	opRemove  = "remove"
+	opRestore = "restore"
+)
+
+const (
+	statusSuccess        = "success"
+	statusFailed         = "failed"
+	statusRolledBack     = "rolled_back"
+	statusRollbackFailed = "rollback_failed"
+)
+
+const (
+	rollbackComplete   = "complete"
+	rollbackIncomplete = "incomplete"
+)
+
+const (
+	skipExcluded    = "excluded"
+	skipKeptMissing = "kept_missing"
+	skipNotSelected = "component_not_selected"
+)
+
+// ReportTotals sums up one kind of file operations
+type ReportTotals struct {
+	Count  int   `json:"count"`
+	Bytes  int64 `json:"bytes"`
+	Failed int   `json:"failed"`
+}
+
+type ReportFile struct {
+	Path      string `json:"path"`
+	Operation string `json:"operation"`
+	Size      int64  `json:"size"`
+	Result    string `json:"result"`
+	Error     string `json:"error,omitempty"`
+}
+
+type ReportSkippedFile struct {
+	Path      string `json:"path"`
+	Operation string `json:"operation,omitempty"`
+	Reason    string `json:"reason"`
+}
+
+// InstallReport is the machine-readable summary of the run
+// written to --report path when ministaller exits and summed up
+// in the install history
+type InstallReport struct {
+	mutex       sync.Mutex
+	Command     string               `json:"command"`
+	RunID       string               `json:"run_id"`
+	Started     time.Time            `json:"started"`
+	Finished    time.Time            `json:"finished"`
+	InstallPath string               `json:"install_path"`
+	Package     string               `json:"package,omitempty"`
+	PackageHash string               `json:"package_hash,omitempty"`
+	FromVersion string               `json:"from_version,omitempty"`
+	ToVersion   string               `json:"to_version,omitempty"`
+	Status      string               `json:"status"`
+	Error       string               `json:"error,omitempty"`
+	Rollback    string               `json:"rollback,omitempty"`
+	NotRestored []string             `json:"not_restored,omitempty"` // files left changed by incomplete rollback
+	Added       ReportTotals         `json:"added"`
+	Updated     ReportTotals         `json:"updated"`
+	Removed     ReportTotals         `json:"removed"`
+	Files       []*ReportFile        `json:"files"`
+	Skipped     []*ReportSkippedFile `json:"skipped"`
+}
+
+var installReport *InstallReport
+
+func NewInstallReport(command, runID, installPath string) *InstallReport {
+	return &InstallReport{
+		Command:     command,
+		RunID:       runID,
+		Started:     time.Now(),
+		InstallPath: installPath,
+		Files:       make([]*ReportFile, 0),
+		Skipped:     make([]*ReportSkippedFile, 0),
+	}
+}
+
+func (r *InstallReport) setPackage(location string) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	r.Package = location
+	r.mutex.Unlock()
+}
+
+func (r *InstallReport) setPackageHash(hash string) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	r.PackageHash = hash
+	r.mutex.Unlock()
+}
+
+func (r *InstallReport) setVersions(from, to string) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	r.FromVersion, r.ToVersion = from, to
+	r.mutex.Unlock()
+}
+
+func (r *InstallReport) recordFile(op, relpath string, size int64, err error) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	rf := &ReportFile{Path: relpath, Operation: op, Size: size, Result: statusSuccess}
+	if err != nil {
+		rf.Result, rf.Error = statusFailed, err.Error()
+	}
+	r.Files = append(r.Files, rf)
+
+	var totals *ReportTotals
+	switch op {
+	case opAdd:
+		totals = &r.Added
+	case opUpdate:
+		totals = &r.Updated
+	case opRemove:
+		totals = &r.Removed
+	case opRestore:
+		if err != nil {
+			r.Rollback = rollbackIncomplete
+		}
+		return
+	default:
+		return
+	}
+
+	if err != nil {
+		totals.Failed++
+	} else {
+		totals.Count++
+		totals.Bytes += size
+	}
+}
+
+func (r *InstallReport) recordSkipped(op, relpath, reason string) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	r.Skipped = append(r.Skipped, &ReportSkippedFile{Path: relpath, Operation: op, Reason: reason})
+	r.mutex.Unlock()
+}
+
+// startRollback is called by installers before changes are reverted
+func (r *InstallReport) startRollback() {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	if len(r.Rollback) == 0 {
+		r.Rollback = rollbackComplete
+	}
+	r.mutex.Unlock()
+}
+
+func (r *InstallReport) finish(err error) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.Finished = time.Now()
+
+	var re *RollbackError
+	if errors.As(err, &re) {
+		r.Rollback = rollbackIncomplete
+		r.NotRestored = re.Files
+	}
+
+	switch {
+	case err == nil:
+		r.Status = statusSuccess
+	case r.Rollback == rollbackIncomplete:
+		r.Status = statusRollbackFailed
+	case r.Rollback == rollbackComplete:
+		r.Status = statusRolledBack
+	default:
+		r.Status = statusFailed
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// Write saves the report replacing previous one if any
+func (r *InstallReport) Write(reportPath string) error {
+	r.mutex.Lock()
+	data, err := json.MarshalIndent(r, "", "  ")
+	r.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(reportPath); len(dir) > 0 {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	err = ioutil.WriteFile(reportPath, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	logFields(LevelInfo, "Report saved", "path", reportPath, "status", r.Status)
+	return nil
+}
+
+// recordFileOp logs the file operation and adds it to the report
+func recordFileOp(op, relpath string, size int64, started time.Time, err error) {
+	logFileOp(op, relpath, started, err)
+	installReport.recordFile(op, relpath, size, err)
+}
+
+var filterOpNames = map[int]string{
+	FilterAdd:    opAdd,
+	FilterUpdate: opUpdate,
+	FilterRemove: opRemove,
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	runningPolicyIgnore = "ignore"
+	runningPolicyFail   = "fail"
+	runningPolicyWait   = "wait"
+	runningPolicyAsk    = "ask"
+	runningPolicyKill   = "kill"
+)
+
+const (
+	processPollInterval  = 500 * time.Millisecond
+	processTerminateWait = 5 * time.Second
+)
+
+// RunningProcess is a process that uses some file in the install dir
+type RunningProcess struct {
+	PID  int
+	Name string
+	Path string
+}
+
+func (rp RunningProcess) String() string {
+	return fmt.Sprintf("%v (pid %v, uses %v)", rp.Name, rp.PID, rp.Path)
+}
+
+var ErrProcessesRunning = errors.New("processes are still using files in the install dir")
+
+// RunningProcessesGuard makes sure nobody uses files in the install dir
+// before install starts according to the policy
+type RunningProcessesGuard struct {
+	installDir       string
+	policy           string
+	timeout          time.Duration
+	progressReporter *ProgressReporter
+}
+
+func (rg *RunningProcessesGuard) Ensure() error {
+	if rg.policy == runningPolicyIgnore {
+		return nil
+	}
+
+	processes := rg.find()
+	if len(processes) == 0 {
+		return nil
+	}
+
+	switch rg.policy {
+	case runningPolicyWait:
+		return rg.wait()
+	case runningPolicyAsk:
+		question := fmt.Sprintf("Some programs are still running (%v). Close them to continue?", processNames(processes))
+		if rg.progressReporter.askConfirmation(question) {
+			return rg.terminate(processes)
+		}
+
+		log.Println("Termination declined. Waiting for processes to exit")
+		return rg.wait()
+	case runningPolicyKill:
+		return rg.terminate(processes)
+	default:
+		return ErrProcessesRunning
+	}
+}
+
+func (rg *RunningProcessesGuard) find() []RunningProcess {
+	processes, err := findProcessesUsing(rg.installDir)
+	if err != nil {
+		logError("Error while looking for running processes: %v", err)
+	}
+
+	for _, p := range processes {
+		logFields(LevelInfo, "Found running process", "pid", p.PID, "name", p.Name, "path", p.Path)
+	}
+
+	return processes
+}
+
+func (rg *RunningProcessesGuard) wait() error {
+	logFields(LevelInfo, "Waiting for processes to exit", "timeout", rg.timeout)
+	rg.progressReporter.sendSystemMessage("Waiting for the application to exit...")
+
+	deadline := time.Now().Add(rg.timeout)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(processPollInterval)
+
+		if processes, _ := findProcessesUsing(rg.installDir); len(processes) == 0 {
+			log.Println("All processes exited")
+			return nil
+		}
+	}
+
+	rg.find()
+	return ErrProcessesRunning
+}
+
+func (rg *RunningProcessesGuard) terminate(processes []RunningProcess) error {
+	rg.progressReporter.sendSystemMessage("Closing the application...")
+
+	for _, p := range processes {
+		logFields(LevelInfo, "Terminating process", "pid", p.PID, "name", p.Name)
+		err := terminateProcess(p.PID, processTerminateWait)
+		if err != nil {
+			logWarn("Error while terminating %v: %v", p.PID, err)
+		}
+	}
+
+	if processes := rg.find(); len(processes) > 0 {
+		return ErrProcessesRunning
+	}
+
+	return nil
+}
+
+func processNames(processes []RunningProcess) string {
+	names := make([]string, 0, len(processes))
+	seen := make(map[string]bool)
+
+	for _, p := range processes {
+		if !seen[p.Name] {
+			seen[p.Name] = true
+			names = append(names, p.Name)
+		}
+	}
+
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SignatureExt       = ".sig"
+	StagingDirExt      = ".staging"
+	manifestSizeLimit  = 64 * 1024 * 1024
+	signatureSizeLimit = 4 * 1024
+	connectTimeout     = 30 * time.Second
+	responseTimeout    = 60 * time.Second
+)
+
+var errSignatureMismatch = errors.New("manifest signature verification failed")
+
+// streamClient fails stalled connections but does not limit
+// the time of the whole download
+var streamClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: connectTimeout}).DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: responseTimeout,
+	},
+}
+
+type streamEntry struct {
+	info  *UpdateFileInfo
+	ready chan struct{}
+	mode  os.FileMode
+	err   error
+}
+
+// StreamPackage downloads tar package over HTTP and writes entries
+// into staging dir as they arrive so that install can start
+// before the whole package is downloaded
+type StreamPackage struct {
+	url              string
+	stagingDir       string
+	manifest         *PackageManifest
+	files            map[string]*UpdateFileInfo
+	entries          map[string]*streamEntry
+	progressReporter *ProgressReporter
+	cancel           context.CancelFunc
+	downloadWG       sync.WaitGroup
+}
+
+// NewStreamPackage starts streaming the package from url into a staging
+// dir next to installDir (so it stays in place when install dir is swapped);
+// manifest must list every file in the package
+func NewStreamPackage(url string, manifest *PackageManifest, installDir string, pr *ProgressReporter) (*StreamPackage, error) {
+	installDir = path.Clean(installDir)
+	stagingDir, err := ioutil.TempDir(path.Dir(installDir), path.Base(installDir)+StagingDirExt)
+	if err != nil {
+		return nil, err
+	}
+
+	sp := &StreamPackage{
+		url:              url,
+		stagingDir:       stagingDir,
+		manifest:         manifest,
+		files:            make(map[string]*UpdateFileInfo),
+		entries:          make(map[string]*streamEntry),
+		progressReporter: pr,
+	}
+
+	for _, fi := range manifest.Files {
+		sp.files[fi.Filepath] = fi
+		sp.entries[fi.Filepath] = &streamEntry{
+			info:  fi,
+			ready: make(chan struct{}),
+			mode:  0644,
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sp.cancel = cancel
+
+	sp.downloadWG.Add(1)
+	go sp.download(ctx)
+
+	return sp, nil
+}
+
+func (sp *StreamPackage) Location() string {
+	return sp.url
+}
+
+func (sp *StreamPackage) Files() map[string]*UpdateFileInfo {
+	return sp.files
+}
+
+// Hashes are always taken from the signed manifest
+func (sp *StreamPackage) Hashes(progress io.Writer, jobs Limiter) map[string]string {
+	hashes := make(map[string]string)
+	for _, fi := range sp.manifest.Files {
+		hashes[fi.Filepath] = fi.Sha1
+	}
+
+	return hashes
+}
+
+func (sp *StreamPackage) Manifest() *PackageManifest {
+	return sp.manifest
+}
+
+// Open blocks until the entry is downloaded and verified
+func (sp *StreamPackage) Open(relpath string) (io.ReadCloser, error) {
+	entry, ok := sp.entries[relpath]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: relpath, Err: os.ErrNotExist}
+	}
+
+	<-entry.ready
+
+	if entry.err != nil {
+		return nil, entry.err
+	}
+
+	return os.Open(path.Join(sp.stagingDir, relpath))
+}
+
+func (sp *StreamPackage) Mode(relpath string) os.FileMode {
+	entry, ok := sp.entries[relpath]
+	if !ok {
+		return 0644
+	}
+
+	<-entry.ready
+	return entry.mode
+}
+
+func (sp *StreamPackage) TotalSize() uint64 {
+	return totalSize(sp.files)
+}
+
+// Close aborts the download if it is still running and removes staging dir
+func (sp *StreamPackage) Close() error {
+	sp.cancel()
+	sp.downloadWG.Wait()
+
+	return os.RemoveAll(sp.stagingDir)
+}
+
+func (sp *StreamPackage) download(ctx context.Context) {
+	defer sp.downloadWG.Done()
+
+	err := sp.streamEntries(ctx)
+	if err != nil {
+		logFields(LevelError, "Streaming download failed", "error", err)
+	} else {
+		log.Println("Streaming download finished")
+		err = &VerificationError{Err: errors.New("file is missing from the package")}
+	}
+
+	var ve *VerificationError
+	if !errors.As(err, &ve) {
+		err = &DownloadError{URL: sp.url, Err: err}
+	}
+
+	// wake up everybody still waiting for the entries
+	for relpath, entry := range sp.entries {
+		select {
+		case <-entry.ready:
+		default:
+			entry.err = fmt.Errorf("%v: %w", relpath, err)
+			close(entry.ready)
+		}
+	}
+}
+
+func (sp *StreamPackage) streamEntries(ctx context.Context) error {
+	logFields(LevelInfo, "Streaming package", "addr", sp.url, "staging_dir", sp.stagingDir)
+
+	req, err := http.NewRequest(http.MethodGet, sp.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := streamClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response status: %v", resp.Status)
+	}
+
+	sp.progressReporter.sendSystemMessage("Downloading the package...")
+
+	var r io.Reader = bufio.NewReader(resp.Body)
+	if magic, err := r.(*bufio.Reader).Peek(2); (err == nil) && (magic[0] == 0x1f) && (magic[1] == 0x8b) {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		relpath := strings.TrimPrefix(path.Clean(header.Name), "./")
+		entry, ok := sp.entries[relpath]
+		if !ok {
+			return fmt.Errorf("file is not listed in the manifest: %v", header.Name)
+		}
+
+		select {
+		case <-entry.ready:
+			return fmt.Errorf("duplicate file in the package: %v", header.Name)
+		default:
+		}
+
+		err = sp.stageEntry(entry, header, tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (sp *StreamPackage) stageEntry(entry *streamEntry, header *tar.Header, r io.Reader) error {
+	relpath := entry.info.Filepath
+	dst := path.Join(sp.stagingDir, relpath)
+
+	err := os.MkdirAll(path.Dir(dst), 0755)
+	if err != nil {
+		return err
+	}
+
+	if header.FileInfo().Mode().Perm() != 0 {
+		entry.mode = header.FileInfo().Mode()
+	}
+
+	hasher := sha1.New()
+	err = writeFile(dst, entry.mode, io.TeeReader(r, hasher))
+	if err != nil {
+		return err
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	if hash != entry.info.Sha1 {
+		log.Printf("Hash mismatch! file=%v expected=%v found=%v", relpath, entry.info.Sha1, hash)
+		return &VerificationError{Err: fmt.Errorf("hash mismatch: %v", relpath)}
+	}
+
+	log.Printf("Staged file %v", relpath)
+	close(entry.ready)
+
+	return nil
+}
+
+// FetchSignedManifest downloads package manifest from url and verifies
+// its ed25519 signature downloaded from url + ".sig"
+func FetchSignedManifest(url, publicKey string) (*PackageManifest, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, flagError("public-key", "invalid public key: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, flagError("public-key", "invalid public key size: %v", len(key))
+	}
+
+	data, err := fetchURL(url, manifestSizeLimit)
+	if err != nil {
+		return nil, &DownloadError{URL: url, Err: err}
+	}
+
+	sigData, err := fetchURL(url+SignatureExt, signatureSizeLimit)
+	if err != nil {
+		return nil, &DownloadError{URL: url + SignatureExt, Err: err}
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigData)))
+	if err != nil {
+		return nil, &VerificationError{Err: fmt.Errorf("invalid manifest signature: %v", err)}
+	}
+
+	if !ed25519.Verify(ed25519.PublicKey(key), data, sig) {
+		return nil, &VerificationError{Err: errSignatureMismatch}
+	}
+
+	logFields(LevelInfo, "Manifest signature verified", "addr", url)
+
+	return parseManifest(data)
+}
+
+func fetchURL(url string, limit int64) ([]byte, error) {
+	logFields(LevelInfo, "Downloading file", "addr", url)
+
+	resp, err := streamClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status: %v (%v)", resp.Status, url)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, limit))
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+var (
+	streamOldFiles = map[string]string{"a.txt": "old a", "b.txt": "old b"}
+	streamNewFiles = map[string]string{"a.txt": "new a", "b.txt": "new b", "c.txt": "new c"}
+)
+
+// serveStreamPackage serves tar package with files and its manifest signed
+// with key; hashes override manifest hashes of the files
+func serveStreamPackage(t *testing.T, files, hashes map[string]string, key ed25519.PrivateKey) *httptest.Server {
+	relpaths := make([]string, 0, len(files))
+	for relpath := range files {
+		relpaths = append(relpaths, relpath)
+	}
+	sort.Strings(relpaths)
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	manifest := &PackageManifest{Version: "2.0"}
+
+	for _, relpath := range relpaths {
+		content := files[relpath]
+		header := &tar.Header{Name: relpath, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+
+		hash, ok := hashes[relpath]
+		if !ok {
+			sum := sha1.Sum([]byte(content))
+			hash = hex.EncodeToString(sum[:])
+		}
+
+		manifest.Files = append(manifest.Files, &UpdateFileInfo{Filepath: relpath, Sha1: hash, FileSize: int64(len(content))})
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/package.tar", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive.Bytes())
+	})
+	mux.HandleFunc("/manifest.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	})
+	mux.HandleFunc("/manifest.json"+SignatureExt, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(signature))
+	})
+
+	return httptest.NewServer(mux)
+}
+
+func generateKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return publicKey, privateKey
+}
+
+// runStreamInstall streams package from server into install dir
+// with old files and makes sure it is rejected without changes
+func runStreamInstall(t *testing.T, server *httptest.Server, publicKey ed25519.PublicKey) {
+	root, err := ioutil.TempDir("", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	installDir := filepath.Join(root, "app")
+	writeTree(t, installDir, streamOldFiles)
+
+	err = runInstall(t, map[string]string{
+		"install-path": installDir,
+		"stream":       "true",
+		"url":          server.URL + "/package.tar",
+		"manifest-url": server.URL + "/manifest.json",
+		"public-key":   base64.StdEncoding.EncodeToString(publicKey),
+	})
+
+	if code := exitCode(err); code != exitCodeVerificationFailed {
+		t.Errorf("exit code %v, expected %v (%v)", code, exitCodeVerificationFailed, err)
+	}
+
+	checkTree(t, installDir, streamOldFiles)
+
+	if _, err := os.Stat(filepath.Join(installDir, "c.txt")); !os.IsNotExist(err) {
+		t.Errorf("c.txt was installed from rejected package")
+	}
+
+	// staging dir next to install dir is removed
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		if name := entry.Name(); (name != "app") && (name != "app"+LockFileExt) {
+			t.Errorf("%v is left next to install dir", name)
+		}
+	}
+}
+
+func TestStreamRejectsBadSignature(t *testing.T) {
+	publicKey, _ := generateKey(t)
+	_, otherKey := generateKey(t)
+
+	server := serveStreamPackage(t, streamNewFiles, nil, otherKey)
+	defer server.Close()
+
+	runStreamInstall(t, server, publicKey)
+}
+
+func TestStreamRejectsHashMismatch(t *testing.T) {
+	publicKey, privateKey := generateKey(t)
+
+	hashes := map[string]string{"b.txt": "0000000000000000000000000000000000000000"}
+	server := serveStreamPackage(t, streamNewFiles, hashes, privateKey)
+	defer server.Close()
+
+	runStreamInstall(t, server, publicKey)
+}
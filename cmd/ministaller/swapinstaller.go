@@ -0,0 +1,521 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+const (
+	StagingExt = ".new"
+	OldExt     = ".old"
+)
+
+// SwapInstaller builds the complete new tree in a sibling directory and
+// swaps it with the install dir in the end (or flips the symlink if
+// install dir is a symlink) so the switch is nearly atomic
+type SwapInstaller struct {
+	progressReporter *ProgressReporter
+	installDir       string
+	pkg              Package
+	stagingDir       string
+	versioned        bool      // switch only via symlink and keep the old tree
+	verifier         *Verifier // rehashes copied files if set
+	healthCheck      *HealthCheck
+	permissions      *PermissionSet
+	freshInstall     bool   // permissions are applied to the whole tree
+	oldDir           string // previous tree until the install is committed
+	jobs             int    // concurrent file operations
+	failInTheEnd     bool   // for debugging purposes
+}
+
+func (si *SwapInstaller) Install(filesProvider UpdateFilesProvider) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			logError("Recovered in swap install... %v", r)
+			si.afterFailure()
+			err = rolledBack(fmt.Errorf("swap install panicked: %v", r))
+		}
+	}()
+
+	kept, err := si.findFilesToKeep(filesProvider)
+	if err != nil {
+		return err
+	}
+
+	si.progressReporter.startPhase(PhaseInstall, si.calculateGrandTotals(kept, filesProvider))
+
+	err = si.buildTree(kept, filesProvider)
+
+	// the new tree is verified before it replaces the old one
+	if (err == nil) && (si.verifier != nil) {
+		err = si.verifier.Verify(si.stagingDir, filesProvider)
+	}
+
+	if err == nil {
+		err = si.permissions.Apply(si.stagingDir, changedFiles(filesProvider), si.freshInstall)
+	}
+
+	if (err == nil) && si.failInTheEnd {
+		err = errors.New("failing swap install on purpose")
+	}
+
+	if err == nil {
+		err = si.swap()
+		// the old tree is kept until the new one passes health check
+		if (err == nil) && (si.healthCheck != nil) {
+			err = si.checkHealth()
+		}
+	}
+
+	if err == nil {
+		si.removeOldTree()
+	} else {
+		si.afterFailure()
+		err = rolledBack(err)
+	}
+
+	si.teardown()
+
+	return err
+}
+
+func (si *SwapInstaller) calculateGrandTotals(kept []string, filesProvider UpdateFilesProvider) uint64 {
+	var sum uint64
+
+	sum += uint64(len(kept) * LinkPrice)
+
+	for _, fi := range filesProvider.FilesToUpdate() {
+		sum += uint64(fi.FileSize*CopyPrice) / 100
+	}
+
+	for _, fi := range filesProvider.FilesToAdd() {
+		sum += uint64(fi.FileSize*CopyPrice) / 100
+	}
+
+	return sum
+}
+
+// findFilesToKeep returns relative paths of all files in the install dir
+// that are neither removed nor updated by the package
+func (si *SwapInstaller) findFilesToKeep(filesProvider UpdateFilesProvider) ([]string, error) {
+	skip := make(map[string]bool)
+	for _, fi := range filesProvider.FilesToRemove() {
+		skip[fi.Filepath] = true
+	}
+	for _, fi := range filesProvider.FilesToUpdate() {
+		skip[fi.Filepath] = true
+	}
+
+	kept := make([]string, 0)
+	realDir := si.realInstallDir()
+
+	if _, err := os.Stat(realDir); os.IsNotExist(err) {
+		logFields(LevelInfo, "Install dir does not exist yet", "path", realDir)
+		return kept, nil
+	}
+
+	err := filepath.Walk(realDir, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			// data dir is moved to the new tree during the swap
+			if isDataDir(realDir, fullpath) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		relativePath, err := filepath.Rel(realDir, fullpath)
+		if err != nil {
+			return err
+		}
+		relativePath = filepath.ToSlash(relativePath)
+
+		if !skip[relativePath] {
+			kept = append(kept, relativePath)
+		}
+
+		return nil
+	})
+
+	logFields(LevelInfo, "Found files to keep", "count", len(kept))
+
+	return kept, err
+}
+
+func (si *SwapInstaller) isSymlinkMode() bool {
+	if si.versioned {
+		return true
+	}
+
+	fi, err := os.Lstat(si.installDir)
+	return (err == nil) && (fi.Mode()&os.ModeSymlink != 0)
+}
+
+// realInstallDir returns the directory install dir points to
+func (si *SwapInstaller) realInstallDir() string {
+	realDir, err := filepath.EvalSymlinks(si.installDir)
+	if err != nil {
+		return si.installDir
+	}
+
+	return filepath.ToSlash(realDir)
+}
+
+func (si *SwapInstaller) chooseStagingDir() string {
+	if len(si.stagingDir) > 0 {
+		return si.stagingDir
+	}
+
+	realDir := si.realInstallDir()
+
+	if si.isSymlinkMode() {
+		name := filepath.Base(si.installDir) + "-" + time.Now().Format("20060102150405")
+		return path.Join(path.Dir(realDir), name)
+	}
+
+	return realDir + StagingExt
+}
+
+func (si *SwapInstaller) buildTree(kept []string, filesProvider UpdateFilesProvider) error {
+	si.stagingDir = si.chooseStagingDir()
+	logFields(LevelInfo, "Building new tree", "staging_dir", si.stagingDir)
+
+	si.progressReporter.sendSystemMessage("Preparing components...")
+
+	// leftovers of the previous failed install
+	if err := os.RemoveAll(si.stagingDir); err != nil {
+		return err
+	}
+
+	err := si.copyDirs()
+	if err != nil {
+		return err
+	}
+
+	realDir := si.realInstallDir()
+
+	for _, relpath := range kept {
+		err = linkOrCopy(path.Join(realDir, relpath), path.Join(si.stagingDir, relpath))
+		if err != nil {
+			logError("Keeping file %v failed: %v", relpath, err)
+			return err
+		}
+
+		si.progressReporter.accountLink()
+	}
+
+	si.progressReporter.sendSystemMessage("Updating components...")
+	err = forEachFile(filesProvider.FilesToUpdate(), si.jobs, func(fi *UpdateFileInfo) error {
+		return si.copyFromPackage(opUpdate, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	si.progressReporter.sendSystemMessage("Adding components...")
+	err = forEachFile(filesProvider.FilesToAdd(), si.jobs, func(fi *UpdateFileInfo) error {
+		return si.copyFromPackage(opAdd, fi)
+	})
+	if err != nil {
+		return err
+	}
+
+	// removed files are just not brought to the new tree
+	for _, fi := range filesProvider.FilesToRemove() {
+		installReport.recordFile(opRemove, fi.Filepath, fi.FileSize, nil)
+	}
+
+	cleanupEmptyDirs(si.stagingDir)
+
+	return nil
+}
+
+// copyDirs recreates directory structure of install dir in staging dir
+func (si *SwapInstaller) copyDirs() error {
+	realDir := si.realInstallDir()
+
+	if _, err := os.Stat(realDir); os.IsNotExist(err) {
+		return os.MkdirAll(si.stagingDir, 0755)
+	}
+
+	return filepath.Walk(realDir, func(fullpath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		if isDataDir(realDir, fullpath) {
+			return filepath.SkipDir
+		}
+
+		relativePath, err := filepath.Rel(realDir, fullpath)
+		if err != nil {
+			return err
+		}
+
+		return os.MkdirAll(filepath.Join(si.stagingDir, relativePath), info.Mode().Perm())
+	})
+}
+
+func (si *SwapInstaller) copyFromPackage(op string, fi *UpdateFileInfo) error {
+	si.progressReporter.sendCurrentFile(fi.Filepath)
+	newpath := path.Join(si.stagingDir, fi.Filepath)
+	started := time.Now()
+	ensureDirExists(newpath)
+
+	err := installFile(si.pkg, fi.Filepath, newpath)
+	recordFileOp(op, fi.Filepath, fi.FileSize, started, err)
+	if err != nil {
+		return err
+	}
+
+	si.progressReporter.accountAdd(fi.FileSize)
+	return nil
+}
+
+func (si *SwapInstaller) swap() error {
+	si.progressReporter.sendSystemMessage("Switching to the new version...")
+
+	if si.isSymlinkMode() {
+		return si.flipSymlink()
+	}
+
+	return si.swapDirs()
+}
+
+func (si *SwapInstaller) swapDirs() error {
+	realDir := si.realInstallDir()
+	oldDir := realDir + OldExt
+	logFields(LevelInfo, "Swapping directories", "install_dir", realDir, "staging_dir", si.stagingDir)
+
+	os.RemoveAll(oldDir)
+
+	err := moveDataDir(realDir, si.stagingDir)
+	if err != nil {
+		logError("Failed to move data dir to the new tree: %v", err)
+		return err
+	}
+
+	err = os.Rename(realDir, oldDir)
+	if err != nil {
+		logError("Failed to move install dir away: %v", err)
+		if derr := moveDataDir(si.stagingDir, realDir); derr != nil {
+			logError("Failed to move data dir back: %v", derr)
+			return &RollbackError{Err: err, Files: []string{DataDirName}}
+		}
+		return err
+	}
+
+	err = os.Rename(si.stagingDir, realDir)
+	if err != nil {
+		logError("Failed to move staging dir into place: %v", err)
+		if rerr := os.Rename(oldDir, realDir); rerr != nil {
+			logError("Failed to restore install dir from %v: %v", oldDir, rerr)
+			return &RollbackError{Err: err, Files: []string{realDir}}
+		}
+		if derr := moveDataDir(si.stagingDir, realDir); derr != nil {
+			logError("Failed to move data dir back: %v", derr)
+			return &RollbackError{Err: err, Files: []string{DataDirName}}
+		}
+		return err
+	}
+
+	si.oldDir = oldDir
+	return nil
+}
+
+func (si *SwapInstaller) flipSymlink() error {
+	// first versioned install has no previous target
+	oldDir := ""
+	if _, err := filepath.EvalSymlinks(si.installDir); err == nil {
+		oldDir = si.realInstallDir()
+	}
+	logFields(LevelInfo, "Flipping symlink", "link", si.installDir, "old_target", oldDir, "new_target", si.stagingDir)
+
+	err := moveDataDir(oldDir, si.stagingDir)
+	if err != nil {
+		logError("Failed to move data dir to the new tree: %v", err)
+		return err
+	}
+
+	err = replaceSymlink(si.installDir, si.stagingDir)
+	if err != nil {
+		if derr := moveDataDir(si.stagingDir, oldDir); derr != nil {
+			logError("Failed to move data dir back: %v", derr)
+			return &RollbackError{Err: err, Files: []string{DataDirName}}
+		}
+		return err
+	}
+
+	si.oldDir = oldDir
+	return nil
+}
+
+// checkHealth runs health check against the new tree and switches
+// back to the old tree if it fails
+func (si *SwapInstaller) checkHealth() error {
+	err := si.healthCheck.Run(si.installDir)
+	if err == nil {
+		return nil
+	}
+
+	logFields(LevelInfo, "Switching back to the old version", "old_dir", si.oldDir)
+	si.progressReporter.sendSystemMessage("Switching back to the old version...")
+
+	realDir := si.realInstallDir()
+	if derr := moveDataDir(realDir, si.oldDir); derr != nil {
+		logError("Failed to move data dir back: %v", derr)
+		return &RollbackError{Err: err, Files: []string{DataDirName}}
+	}
+
+	if si.isSymlinkMode() && (len(si.oldDir) == 0) {
+		// link pointing to itself would be left otherwise
+		logFields(LevelInfo, "Removing link without previous target", "link", si.installDir)
+		if lerr := os.Remove(si.installDir); lerr != nil {
+			logError("Failed to remove %v: %v", si.installDir, lerr)
+			return &RollbackError{Err: err, Files: []string{si.installDir}}
+		}
+
+		return err
+	}
+
+	if si.isSymlinkMode() {
+		if lerr := replaceSymlink(si.installDir, si.oldDir); lerr != nil {
+			logError("Failed to switch back to %v: %v", si.oldDir, lerr)
+			return &RollbackError{Err: err, Files: []string{si.installDir}}
+		}
+
+		return err
+	}
+
+	if rerr := os.Rename(realDir, si.stagingDir); rerr != nil {
+		logError("Failed to move new install dir away: %v", rerr)
+		return &RollbackError{Err: err, Files: []string{realDir}}
+	}
+
+	if rerr := os.Rename(si.oldDir, realDir); rerr != nil {
+		logError("Failed to restore install dir from %v: %v", si.oldDir, rerr)
+		return &RollbackError{Err: err, Files: []string{realDir}}
+	}
+
+	return err
+}
+
+// removeOldTree removes previous tree after the install is committed
+// (versioned layout keeps old versions)
+func (si *SwapInstaller) removeOldTree() {
+	if (len(si.oldDir) == 0) || si.versioned {
+		return
+	}
+
+	log.Printf("Removing old install dir %v", si.oldDir)
+	if err := os.RemoveAll(si.oldDir); err != nil {
+		logWarn("Error while removing %v: %v", si.oldDir, err)
+	}
+}
+
+func (si *SwapInstaller) afterFailure() {
+	log.Println("After failure")
+	si.progressReporter.sendSystemMessage("Cleaning up...")
+
+	// the old tree is left untouched until the swap succeeds
+	installReport.startRollback()
+
+	if len(si.stagingDir) == 0 {
+		return
+	}
+
+	log.Printf("Removing staging dir %v", si.stagingDir)
+	if err := os.RemoveAll(si.stagingDir); err != nil {
+		logWarn("Error while removing %v: %v", si.stagingDir, err)
+	}
+}
+
+func (si *SwapInstaller) teardown() {
+	log.Println("Teardown stage!")
+
+	si.progressReporter.waitProgressReported()
+	si.progressReporter.shutdown()
+	si.progressReporter.receiveFinish()
+}
+
+// replaceSymlink atomically points link to target by renaming
+// a freshly created temporary symlink over the old one
+func replaceSymlink(link, target string) error {
+	linkTarget := target
+	if current, err := os.Readlink(link); err != nil || !filepath.IsAbs(current) {
+		if rel, err := filepath.Rel(filepath.Dir(link), target); err == nil {
+			linkTarget = rel
+		}
+	}
+
+	tmpLink := link + StagingExt
+	os.Remove(tmpLink)
+
+	err := os.Symlink(linkTarget, tmpLink)
+	if err != nil {
+		logError("Failed to create symlink %v: %v", tmpLink, err)
+		return err
+	}
+
+	err = os.Rename(tmpLink, link)
+	if err != nil {
+		logError("Failed to replace symlink %v: %v", link, err)
+		os.Remove(tmpLink)
+	}
+
+	return err
+}
+
+// moveDataDir moves ministaller's data dir from one tree to another
+func moveDataDir(from, to string) error {
+	if (len(from) == 0) || (len(to) == 0) {
+		return nil
+	}
+
+	src := path.Join(from, DataDirName)
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+
+	logFields(LevelInfo, "Moving data dir", "from", from, "to", to)
+	return os.Rename(src, path.Join(to, DataDirName))
+}
+
+// linkOrCopy hardlinks src to dst and falls back to copying
+// when hardlinks are not possible (e.g. different filesystems)
+func linkOrCopy(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+
+		return os.Symlink(target, dst)
+	}
+
+	err = os.Link(src, dst)
+	if err == nil {
+		return nil
+	}
+
+	logWarn("Failed to link %v: %v. Copying instead", src, err)
+	return copyFile(src, dst)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwapInstallSwitchesTrees(t *testing.T) {
+	root, err := ioutil.TempDir("", "swap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	installDir := filepath.Join(root, "app")
+	dataFile := DataDirName + "/data.txt"
+	writeTree(t, installDir, map[string]string{"a.txt": "old a", "b.txt": "same", "old.txt": "old", dataFile: "data"})
+
+	newFiles := map[string]string{"a.txt": "new a", "b.txt": "same", "lib/c.txt": "new c"}
+	err = runInstall(t, map[string]string{
+		"install-path": installDir,
+		"package-path": writePackage(t, root, newFiles),
+		"strategy":     strategySwap,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkTree(t, installDir, newFiles)
+
+	if _, err := os.Stat(filepath.Join(installDir, "old.txt")); !os.IsNotExist(err) {
+		t.Errorf("old.txt was not removed")
+	}
+
+	// data dir is moved into the new tree
+	checkTree(t, installDir, map[string]string{dataFile: "data"})
+
+	for _, ext := range []string{StagingExt, OldExt} {
+		if _, err := os.Stat(installDir + ext); !os.IsNotExist(err) {
+			t.Errorf("%v is left after install", installDir+ext)
+		}
+	}
+}
+
+func TestSwapInstallKeepsOldTreeOnFailure(t *testing.T) {
+	root, err := ioutil.TempDir("", "swap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	installDir := filepath.Join(root, "app")
+	oldFiles := map[string]string{"a.txt": "old a", "old.txt": "old"}
+	writeTree(t, installDir, oldFiles)
+
+	err = runInstall(t, map[string]string{
+		"install-path": installDir,
+		"package-path": writePackage(t, root, map[string]string{"a.txt": "new a"}),
+		"strategy":     strategySwap,
+		"fail":         "true",
+	})
+
+	if code := exitCode(err); code != exitCodeRolledBack {
+		t.Errorf("exit code %v, expected %v (%v)", code, exitCodeRolledBack, err)
+	}
+
+	checkTree(t, installDir, oldFiles)
+
+	if _, err := os.Stat(installDir + StagingExt); !os.IsNotExist(err) {
+		t.Errorf("staging dir is left after failed install")
+	}
+}
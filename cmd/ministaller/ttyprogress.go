@@ -0,0 +1,217 @@
+// +build !windows
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	ttyRedrawInterval = 100 * time.Millisecond
+	ttyBarWidth       = 25
+	ttyDefaultColumns = 80
+)
+
+// TTYProgressHandler draws progress bar with current stage, file,
+// speed and ETA in the terminal
+type TTYProgressHandler struct {
+	UIProgressHandler
+	mutex    sync.Mutex
+	out      io.Writer
+	message  string
+	file     string
+	percent  int
+	current  uint64
+	total    uint64
+	started  time.Time
+	lastDraw time.Time
+}
+
+func NewTTYProgressHandler(out io.Writer) *TTYProgressHandler {
+	return &TTYProgressHandler{
+		out:     out,
+		message: "Preparing the install...",
+		started: time.Now(),
+	}
+}
+
+func (ph *TTYProgressHandler) HandleSystemMessage(msg string) {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	ph.message = msg
+	ph.redraw(true)
+}
+
+func (ph *TTYProgressHandler) HandlePhaseChange(phase string) {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	// speed and ETA are calculated per phase
+	ph.started = time.Now()
+	ph.current, ph.total = 0, 0
+	ph.file = ""
+}
+
+func (ph *TTYProgressHandler) HandlePercentChange(percent int) {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	ph.percent = percent
+	ph.redraw(true)
+}
+
+func (ph *TTYProgressHandler) HandleProgress(current, total uint64) {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	ph.current, ph.total = current, total
+	ph.redraw(false)
+}
+
+func (ph *TTYProgressHandler) HandleFileChange(relpath string) {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	ph.file = relpath
+	ph.redraw(false)
+}
+
+func (ph *TTYProgressHandler) HandleConfirmation(question string) bool {
+	if !isTerminal(os.Stdin) {
+		return false
+	}
+
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	fmt.Fprintf(ph.out, "\r\033[K%v [y/N] ", question)
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return (answer == "y") || (answer == "yes")
+}
+
+func (ph *TTYProgressHandler) HandleFinish() {
+	ph.mutex.Lock()
+	ph.file = ""
+	ph.redraw(true)
+	fmt.Fprintln(ph.out)
+	ph.mutex.Unlock()
+
+	ph.UIProgressHandler.HandleFinish()
+}
+
+func (ph *TTYProgressHandler) redraw(force bool) {
+	now := time.Now()
+	if !force && now.Sub(ph.lastDraw) < ttyRedrawInterval {
+		return
+	}
+	ph.lastDraw = now
+
+	filled := ph.percent * ttyBarWidth / 100
+	bar := strings.Repeat("#", filled) + strings.Repeat("-", ttyBarWidth-filled)
+
+	line := fmt.Sprintf("[%v] %3d%% %v", bar, ph.percent, ph.message)
+
+	elapsed := now.Sub(ph.started).Seconds()
+	if (ph.current > 0) && (elapsed > 0) {
+		speed := float64(ph.current) / elapsed
+		line += " " + formatBytes(uint64(speed)) + "/s"
+
+		if (ph.total > ph.current) && (speed > 0) {
+			eta := time.Duration(float64(ph.total-ph.current)/speed) * time.Second
+			line += " ETA " + eta.String()
+		}
+	}
+
+	if len(ph.file) > 0 {
+		line += " " + ph.file
+	}
+
+	columns := terminalColumns()
+	if len(line) >= columns {
+		line = line[:columns-1]
+	}
+
+	fmt.Fprintf(ph.out, "\r\033[K%v", line)
+}
+
+// PlainProgressHandler prints progress as separate lines
+// when stdout is redirected to a file or a pipe
+type PlainProgressHandler struct {
+	UIProgressHandler
+	mutex   sync.Mutex
+	out     io.Writer
+	message string
+	percent int
+}
+
+func NewPlainProgressHandler(out io.Writer) *PlainProgressHandler {
+	return &PlainProgressHandler{out: out}
+}
+
+func (ph *PlainProgressHandler) HandleSystemMessage(msg string) {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	ph.message = msg
+	fmt.Fprintf(ph.out, "%3d%% %v\n", ph.percent, ph.message)
+}
+
+func (ph *PlainProgressHandler) HandlePercentChange(percent int) {
+	ph.mutex.Lock()
+	defer ph.mutex.Unlock()
+
+	ph.percent = percent
+	fmt.Fprintf(ph.out, "%3d%% %v\n", ph.percent, ph.message)
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+func terminalColumns() int {
+	var ws struct {
+		rows, cols, xpixel, ypixel uint16
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL,
+		os.Stdout.Fd(),
+		uintptr(syscall.TIOCGWINSZ),
+		uintptr(unsafe.Pointer(&ws)))
+	if (errno != 0) || (ws.cols == 0) {
+		return ttyDefaultColumns
+	}
+
+	return int(ws.cols)
+}
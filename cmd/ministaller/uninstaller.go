@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+)
+
+// removalsProvider is a diff that only removes files
+type removalsProvider struct {
+	files []*UpdateFileInfo
+}
+
+func (rp *removalsProvider) FilesToAdd() []*UpdateFileInfo {
+	return nil
+}
+
+func (rp *removalsProvider) FilesToUpdate() []*UpdateFileInfo {
+	return nil
+}
+
+func (rp *removalsProvider) FilesToRemove() []*UpdateFileInfo {
+	return rp.files
+}
+
+// Uninstaller removes files recorded in the install state
+// keeping files created or modified by the user and files
+// protected by filters
+type Uninstaller struct {
+	progressReporter *ProgressReporter
+	installDir       string // where install state is stored
+	targetDir        string // where files are (active version for versioned layout)
+	state            *InstallState
+	filters          *PathFilter
+	dryRun           bool
+	jobs             int  // concurrent file operations
+	failInTheEnd     bool // for debugging purposes
+}
+
+func (u *Uninstaller) Uninstall() error {
+	files, kept := u.findFilesToRemove()
+	logFields(LevelInfo, "Found files to uninstall", "remove", len(files), "keep", len(kept))
+
+	if u.dryRun {
+		u.reportPlan(files, kept)
+		return nil
+	}
+
+	err := u.runHook()
+	if err != nil {
+		return err
+	}
+
+	pi := &PackageInstaller{
+		backups:          make(map[string]string),
+		backupsChan:      make(chan BackupPair),
+		progressReporter: u.progressReporter,
+		installDir:       u.targetDir,
+		strictRemove:     true,
+		jobs:             u.jobs,
+		failInTheEnd:     u.failInTheEnd,
+	}
+
+	// install with removals only rolls back if any file cannot be removed
+	err = pi.Install(&removalsProvider{files: files})
+	if err != nil {
+		return err
+	}
+
+	if u.state.Layout == layoutVersioned {
+		u.removeVersions()
+	}
+
+	err = os.Remove(path.Join(u.installDir, DataDirName, StateFileName))
+	if err != nil {
+		logFields(LevelError, "Failed to remove install state", "error", err)
+	}
+
+	return nil
+}
+
+// findFilesToRemove splits recorded files into the ones safe to remove
+// and the ones to keep (modified by the user or protected)
+func (u *Uninstaller) findFilesToRemove() (files []*UpdateFileInfo, kept []string) {
+	files = make([]*UpdateFileInfo, 0, len(u.state.Files))
+
+	for _, fi := range u.state.Files {
+		fullpath := path.Join(u.targetDir, fi.Filepath)
+
+		info, err := os.Stat(fullpath)
+		if os.IsNotExist(err) {
+			logFields(LevelInfo, "Installed file is already missing", "path", fi.Filepath)
+			continue
+		}
+
+		if (err != nil) || !info.Mode().IsRegular() {
+			logFields(LevelInfo, "Keeping file that is not a regular file", "path", fi.Filepath, "error", err)
+			kept = append(kept, fi.Filepath)
+			continue
+		}
+
+		if u.filters.Skips(FilterRemove, fi.Filepath) {
+			logFields(LevelInfo, "Keeping protected file", "path", fi.Filepath)
+			kept = append(kept, fi.Filepath)
+			continue
+		}
+
+		hash, err := calculateFileHash(fullpath)
+		if (err != nil) || ((len(fi.Sha1) > 0) && (hash != fi.Sha1)) {
+			logFields(LevelInfo, "Keeping file modified after install", "path", fi.Filepath)
+			kept = append(kept, fi.Filepath)
+			continue
+		}
+
+		files = append(files, &UpdateFileInfo{
+			Filepath: fi.Filepath,
+			Sha1:     hash,
+			FileSize: info.Size(),
+		})
+	}
+
+	return files, kept
+}
+
+func (u *Uninstaller) reportPlan(files []*UpdateFileInfo, kept []string) {
+	if len(u.state.UninstallHook) > 0 {
+		fmt.Printf("run hook: %v\n", u.state.UninstallHook)
+	}
+
+	for _, fi := range files {
+		fmt.Printf("remove: %v\n", fi.Filepath)
+	}
+
+	for _, relpath := range kept {
+		fmt.Printf("keep: %v\n", relpath)
+	}
+}
+
+// runHook runs uninstall hook installed from the package (if any)
+// and aborts uninstall if the hook fails
+func (u *Uninstaller) runHook() error {
+	if len(u.state.UninstallHook) == 0 {
+		return nil
+	}
+
+	hookPath := resolveCommandPath(u.targetDir, u.state.UninstallHook)
+	if _, err := os.Stat(hookPath); os.IsNotExist(err) {
+		logFields(LevelInfo, "Uninstall hook is missing", "path", hookPath)
+		return nil
+	}
+
+	logFields(LevelInfo, "Running uninstall hook", "path", hookPath)
+	u.progressReporter.sendSystemMessage("Running uninstall hook...")
+
+	cmd := exec.Command(hookPath)
+	cmd.Dir = filepath.FromSlash(u.targetDir)
+	cmd.Env = append(os.Environ(), envPrefix+"INSTALL_PATH="+u.installDir)
+
+	output, err := cmd.CombinedOutput()
+	logFields(LevelInfo, "Uninstall hook finished", "output", string(output))
+
+	if err != nil {
+		return fmt.Errorf("uninstall hook failed: %v", err)
+	}
+
+	return nil
+}
+
+// resolveCommandPath returns absolute native path of the executable
+// relpath in root since relative one would be resolved against cmd.Dir
+func resolveCommandPath(root, relpath string) string {
+	fullpath := filepath.FromSlash(path.Join(root, relpath))
+	if absPath, err := filepath.Abs(fullpath); err == nil {
+		return absPath
+	}
+
+	return fullpath
+}
+
+// removeVersions removes versions dir and current symlink
+// if nothing but ministaller's files were left there
+func (u *Uninstaller) removeVersions() {
+	versionsDir := path.Join(u.installDir, VersionsDirName)
+
+	if entries, err := ioutil.ReadDir(u.targetDir); (err == nil) && (len(entries) > 0) {
+		logFields(LevelInfo, "Active version is not empty. Keeping versions", "path", u.targetDir)
+		return
+	}
+
+	entries, err := ioutil.ReadDir(versionsDir)
+	if err != nil {
+		logWarn("Error while listing versions: %v", err)
+		return
+	}
+
+	for _, e := range entries {
+		versionDir := path.Join(versionsDir, e.Name())
+		log.Printf("Removing version %v", versionDir)
+
+		if err := os.RemoveAll(versionDir); err != nil {
+			logWarn("Error while removing %v: %v", versionDir, err)
+		}
+	}
+
+	os.Remove(versionsDir)
+	os.Remove(path.Join(u.installDir, CurrentLinkName))
+}
+
+// removeEmptyInstallDir removes ministaller's own files and install dir
+// after everything else has been uninstalled; install history is kept
+// while anything else is left in the install dir
+func removeEmptyInstallDir(installDir string) {
+	dataDir := path.Join(installDir, DataDirName)
+
+	if _, err := os.Stat(path.Join(dataDir, StateFileName)); err == nil {
+		return
+	}
+
+	if entries, err := ioutil.ReadDir(installDir); (err != nil) || (len(entries) != 1) {
+		return
+	}
+
+	os.Remove(path.Join(dataDir, HistoryFileName))
+	os.Remove(dataDir)
+
+	if err := os.Remove(installDir); err == nil {
+		logFields(LevelInfo, "Removed empty install dir", "path", installDir)
+		os.Remove(lockFilePath(installDir))
+	}
+}
@@ -3,11 +3,107 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const (
+	accessWriteOK = 0x2
+	sysBlockRoot  = "/sys/dev/block"
 )
 
 func executablePath() string {
 	fullpath, _ := exec.LookPath(os.Args[0])
 	return fullpath
 }
+
+func diskFreeSpace(dirpath string) (uint64, error) {
+	var st syscall.Statfs_t
+
+	err := syscall.Statfs(dirpath, &st)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+func fileSystemID(dirpath string) (string, error) {
+	fi, err := os.Stat(dirpath)
+	if err != nil {
+		return "", err
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return dirpath, nil
+	}
+
+	return fmt.Sprintf("%v", uint64(st.Dev)), nil
+}
+
+func isFileWritable(fullpath string) bool {
+	return syscall.Access(fullpath, accessWriteOK) == nil
+}
+
+// isFileLocked checks if somebody holds an advisory lock on the file
+func isFileLocked(fullpath string) bool {
+	f, err := os.Open(fullpath)
+	if err != nil {
+		return false
+	}
+
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return true
+	}
+
+	if err == nil {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	}
+
+	return false
+}
+
+// blockDeviceInfo returns name of the disk containing the path and
+// whether it is rotational (works only with Linux sysfs)
+func blockDeviceInfo(fullpath string) (string, bool, error) {
+	fi, err := os.Stat(fullpath)
+	if err != nil {
+		return "", false, err
+	}
+
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return "", false, fmt.Errorf("unknown device of %v", fullpath)
+	}
+
+	dev := uint64(st.Dev)
+	major := ((dev >> 8) & 0xfff) | ((dev >> 32) &^ 0xfff)
+	minor := (dev & 0xff) | ((dev >> 12) &^ 0xff)
+
+	devicePath, err := filepath.EvalSymlinks(filepath.Join(sysBlockRoot, fmt.Sprintf("%v:%v", major, minor)))
+	if err != nil {
+		return "", false, err
+	}
+
+	// partitions keep queue settings in the parent disk
+	diskPath := devicePath
+	if _, err := os.Stat(filepath.Join(devicePath, "partition")); err == nil {
+		diskPath = filepath.Dir(devicePath)
+	}
+
+	rotational, err := ioutil.ReadFile(filepath.Join(diskPath, "queue", "rotational"))
+	if err != nil {
+		return "", false, err
+	}
+
+	return filepath.Base(diskPath), strings.TrimSpace(string(rotational)) == "1", nil
+}
@@ -1,17 +1,24 @@
 package main
 
 import (
+	"errors"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"unicode/utf16"
 	"unsafe"
 )
 
+const (
+	errorSharingViolation syscall.Errno = 32
+)
+
 var (
-	kernel                = syscall.MustLoadDLL("kernel32.dll")
-	getModuleFileNameProc = kernel.MustFindProc("GetModuleFileNameW")
+	kernel                 = syscall.MustLoadDLL("kernel32.dll")
+	getModuleFileNameProc  = kernel.MustFindProc("GetModuleFileNameW")
+	getDiskFreeSpaceExProc = kernel.MustFindProc("GetDiskFreeSpaceExW")
 )
 
 func getModuleFileName() (string, error) {
@@ -36,3 +43,68 @@ func executablePath() string {
 
 	return filepath.ToSlash(exepath)
 }
+
+func diskFreeSpace(dirpath string) (uint64, error) {
+	var freeBytesAvailable uint64
+
+	dirpathPtr, err := syscall.UTF16PtrFromString(filepath.FromSlash(dirpath))
+	if err != nil {
+		return 0, err
+	}
+
+	ret, _, err := getDiskFreeSpaceExProc.Call(
+		uintptr(unsafe.Pointer(dirpathPtr)),
+		uintptr(unsafe.Pointer(&freeBytesAvailable)),
+		0,
+		0)
+	if ret == 0 {
+		return 0, err
+	}
+
+	return freeBytesAvailable, nil
+}
+
+func fileSystemID(dirpath string) (string, error) {
+	abspath, err := filepath.Abs(dirpath)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.ToUpper(filepath.VolumeName(abspath)), nil
+}
+
+func isFileWritable(fullpath string) bool {
+	fi, err := os.Stat(fullpath)
+	if err != nil {
+		return false
+	}
+
+	// read-only attribute
+	return fi.Mode().Perm()&0200 != 0
+}
+
+// isFileLocked checks if the file can be opened exclusively
+func isFileLocked(fullpath string) bool {
+	pathPtr, err := syscall.UTF16PtrFromString(filepath.FromSlash(fullpath))
+	if err != nil {
+		return false
+	}
+
+	h, err := syscall.CreateFile(pathPtr,
+		syscall.GENERIC_READ,
+		0, // no sharing
+		nil,
+		syscall.OPEN_EXISTING,
+		syscall.FILE_ATTRIBUTE_NORMAL,
+		0)
+	if err != nil {
+		return err == errorSharingViolation
+	}
+
+	syscall.CloseHandle(h)
+	return false
+}
+
+func blockDeviceInfo(fullpath string) (string, bool, error) {
+	return "", false, errors.New("disk type detection is not supported")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	opVerify = "verify"
+
+	// how many mismatched files are listed in the error
+	verifyErrorFilesLimit = 10
+)
+
+// Verifier rehashes added and updated files after they were copied
+// and compares them with the package before the install is committed
+type Verifier struct {
+	hashes           map[string]string // expected sha1 by relative path
+	progressReporter *ProgressReporter
+	jobs             int
+}
+
+// NewVerifier prefers hashes from the package manifest and falls back
+// to the ones calculated while generating the diff
+func NewVerifier(df *DiffGenerator, jobs int) *Verifier {
+	hashes := make(map[string]string, len(df.packageDirHashes))
+	for relpath, hash := range df.packageDirHashes {
+		hashes[relpath] = hash
+	}
+
+	if manifest := df.pkg.Manifest(); manifest != nil {
+		for _, fi := range manifest.Files {
+			if len(fi.Sha1) > 0 {
+				hashes[fi.Filepath] = fi.Sha1
+			}
+		}
+	}
+
+	return &Verifier{
+		hashes:           hashes,
+		progressReporter: df.progressReporter,
+		jobs:             jobs,
+	}
+}
+
+// Verify checks files in dir and returns VerificationError
+// listing all files that do not match
+func (v *Verifier) Verify(dir string, filesProvider UpdateFilesProvider) error {
+	files := append(append([]*UpdateFileInfo{}, filesProvider.FilesToAdd()...), filesProvider.FilesToUpdate()...)
+	logFields(LevelInfo, "Verifying installed files", "count", len(files), "dir", dir)
+	v.progressReporter.sendSystemMessage("Verifying installed files...")
+
+	var mutex sync.Mutex
+	mismatched := make([]string, 0)
+
+	forEachFile(files, v.jobs, func(fi *UpdateFileInfo) error {
+		started := time.Now()
+		err := v.verifyFile(dir, fi.Filepath)
+		if err != nil {
+			recordFileOp(opVerify, fi.Filepath, fi.FileSize, started, err)
+
+			mutex.Lock()
+			mismatched = append(mismatched, fi.Filepath)
+			mutex.Unlock()
+		}
+
+		// all files are checked to report every mismatch
+		return nil
+	})
+
+	if len(mismatched) == 0 {
+		log.Println("Installed files verified")
+		return nil
+	}
+
+	sort.Strings(mismatched)
+	logFields(LevelError, "Installed files do not match the package", "files", mismatched)
+
+	listed := mismatched
+	if len(listed) > verifyErrorFilesLimit {
+		listed = listed[:verifyErrorFilesLimit]
+	}
+
+	return &VerificationError{
+		Err: fmt.Errorf("%v installed files do not match the package: %v", len(mismatched), strings.Join(listed, ", ")),
+	}
+}
+
+func (v *Verifier) verifyFile(dir, relpath string) error {
+	expected, ok := v.hashes[relpath]
+	if !ok || (len(expected) == 0) {
+		return errors.New("expected hash is unknown")
+	}
+
+	hash, err := calculateFileHash(path.Join(dir, relpath))
+	if err != nil {
+		return err
+	}
+
+	if !strings.EqualFold(hash, expected) {
+		return fmt.Errorf("hash mismatch: expected %v, found %v", expected, hash)
+	}
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	VersionsDirName   = "versions"
+	CurrentLinkName   = "current"
+	versionTimeFormat = "20060102150405"
+)
+
+// VersionedInstaller keeps every version in <root>/versions/<version>/
+// and switches <root>/current symlink to the active one
+type VersionedInstaller struct {
+	SwapInstaller
+	rootDir      string
+	version      string
+	keepVersions int
+}
+
+func NewVersionedInstaller(rootDir string, pkg Package, version string, keepVersions int, progressReporter *ProgressReporter) *VersionedInstaller {
+	return &VersionedInstaller{
+		SwapInstaller: SwapInstaller{
+			progressReporter: progressReporter,
+			installDir:       path.Join(rootDir, CurrentLinkName),
+			pkg:              pkg,
+			stagingDir:       path.Join(rootDir, VersionsDirName, version),
+			versioned:        true,
+		},
+		rootDir:      rootDir,
+		version:      version,
+		keepVersions: keepVersions,
+	}
+}
+
+func (vi *VersionedInstaller) Install(filesProvider UpdateFilesProvider) error {
+	logFields(LevelInfo, "Installing version", "version", vi.version, "root", vi.rootDir)
+
+	versionDir := vi.stagingDir
+
+	if activeDir, err := filepath.EvalSymlinks(vi.installDir); err == nil {
+		if versionAbs, err := filepath.Abs(versionDir); err == nil {
+			if activeAbs, err := filepath.Abs(activeDir); err == nil && (activeAbs == versionAbs) {
+				return errors.New("version " + vi.version + " is already active")
+			}
+		}
+	}
+
+	err := os.MkdirAll(path.Dir(versionDir), 0755)
+	if err != nil {
+		return err
+	}
+
+	err = vi.SwapInstaller.Install(filesProvider)
+	if err != nil {
+		return err
+	}
+
+	vi.removeOldVersions()
+
+	return nil
+}
+
+// removeOldVersions garbage-collects all versions except
+// the active one and keepVersions-1 most recent others
+func (vi *VersionedInstaller) removeOldVersions() {
+	if vi.keepVersions <= 0 {
+		log.Println("Keeping all old versions")
+		return
+	}
+
+	versionsDir := path.Join(vi.rootDir, VersionsDirName)
+
+	entries, err := ioutil.ReadDir(versionsDir)
+	if err != nil {
+		logWarn("Error while listing versions: %v", err)
+		return
+	}
+
+	activeVersion := path.Base(vi.stagingDir)
+	old := make([]os.FileInfo, 0, len(entries))
+
+	for _, e := range entries {
+		if !e.IsDir() || (e.Name() == activeVersion) {
+			continue
+		}
+
+		old = append(old, e)
+	}
+
+	order := vi.installOrder()
+
+	// newest first; versions missing from the history go last
+	sort.Slice(old, func(i, j int) bool {
+		oi, iok := order[old[i].Name()]
+		oj, jok := order[old[j].Name()]
+		if iok != jok {
+			return iok
+		}
+		if oi != oj {
+			return oi > oj
+		}
+
+		return old[i].Name() > old[j].Name()
+	})
+
+	keepOld := vi.keepVersions - 1
+	if keepOld >= len(old) {
+		logFields(LevelInfo, "No old versions to remove", "count", len(old))
+		return
+	}
+
+	for _, e := range old[keepOld:] {
+		versionDir := path.Join(versionsDir, e.Name())
+		log.Printf("Removing old version %v", versionDir)
+
+		err := os.RemoveAll(versionDir)
+		if err != nil {
+			logWarn("Error while removing %v: %v", versionDir, err)
+		}
+	}
+}
+
+// installOrder maps versions to the position of their last successful
+// install in the history (dir times change whenever a dir is touched)
+func (vi *VersionedInstaller) installOrder() map[string]int {
+	order := make(map[string]int)
+
+	entries, err := ReadHistory(vi.rootDir)
+	if err != nil {
+		logWarn("Error while reading install history: %v", err)
+		return order
+	}
+
+	for i, e := range entries {
+		if (e.Command == commandInstall) && (e.Result == statusSuccess) && (len(e.ToVersion) > 0) {
+			order[e.ToVersion] = i
+		}
+	}
+
+	return order
+}
+
+// packageVersion prefers explicit --version over the version declared
+// in the package manifest; versioned layout names version dirs after it,
+// so a timestamp is used when there is no version at all
+func packageVersion(pkg Package) (string, error) {
+	version := *versionFlag
+	if manifest := pkg.Manifest(); (len(version) == 0) && (manifest != nil) {
+		version = manifest.Version
+	}
+
+	if !isSafeVersion(version) {
+		return "", fmt.Errorf("package version %q cannot be used as a dir name", version)
+	}
+
+	if (len(version) == 0) && (*layoutFlag == layoutVersioned) {
+		version = time.Now().Format(versionTimeFormat)
+	}
+
+	return version, nil
+}
+
+func isSafeVersion(version string) bool {
+	return !strings.ContainsAny(version, "/\\") && (version != ".") && (version != "..")
+}
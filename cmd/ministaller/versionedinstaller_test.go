@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+)
+
+func TestPackageVersion(t *testing.T) {
+	defer func(version, layout string) {
+		*versionFlag, *layoutFlag = version, layout
+	}(*versionFlag, *layoutFlag)
+
+	tests := []struct {
+		flag     string
+		manifest string
+		expected string
+	}{
+		{"2.0", "1.0", "2.0"},
+		{"", "1.0", "1.0"},
+		{"2.0", "", "2.0"},
+	}
+
+	for _, tt := range tests {
+		*versionFlag = tt.flag
+		pkg := &DirPackage{manifest: &PackageManifest{Version: tt.manifest}}
+
+		version, err := packageVersion(pkg)
+		if err != nil {
+			t.Errorf("packageVersion(%q, %q) failed: %v", tt.flag, tt.manifest, err)
+			continue
+		}
+
+		if version != tt.expected {
+			t.Errorf("packageVersion(%q, %q) = %q, expected %q", tt.flag, tt.manifest, version, tt.expected)
+		}
+	}
+
+	*versionFlag = ""
+	*layoutFlag = layoutVersioned
+	version, err := packageVersion(&DirPackage{})
+	if (err != nil) || (len(version) == 0) {
+		t.Errorf("packageVersion without version = %q, %v, expected timestamp", version, err)
+	}
+
+	*versionFlag = "../1.0"
+	if _, err := packageVersion(&DirPackage{}); err == nil {
+		t.Errorf("packageVersion accepted unsafe version %q", *versionFlag)
+	}
+}
+
+func TestVersionedInstallFlipsCurrentLink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks requires privileges")
+	}
+
+	root, err := ioutil.TempDir("", "versioned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	installDir := filepath.Join(root, "app")
+	currentLink := filepath.Join(installDir, CurrentLinkName)
+
+	// versions are installed out of name order to check pruning order
+	versions := []string{"3", "1", "4", "2"}
+	for _, version := range versions {
+		files := map[string]string{"version.txt": version}
+		err := runInstall(t, map[string]string{
+			"install-path":  installDir,
+			"package-path":  writePackage(t, root, files),
+			"layout":        layoutVersioned,
+			"version":       version,
+			"keep-versions": "2",
+		})
+		if err != nil {
+			t.Fatalf("install of %v failed: %v", version, err)
+		}
+
+		target, err := os.Readlink(currentLink)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if filepath.Base(target) != version {
+			t.Errorf("current link points to %v, expected version %v", target, version)
+		}
+
+		checkTree(t, currentLink, files)
+	}
+
+	entries, err := ioutil.ReadDir(filepath.Join(installDir, VersionsDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		kept = append(kept, entry.Name())
+	}
+
+	// the most recently installed versions are kept
+	if expected := []string{"2", "4"}; !reflect.DeepEqual(kept, expected) {
+		t.Errorf("kept versions %v, expected %v", kept, expected)
+	}
+}
+
+func TestVersionedInstallKeepsCurrentLinkOnFailure(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symlinks requires privileges")
+	}
+
+	root, err := ioutil.TempDir("", "versioned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	installDir := filepath.Join(root, "app")
+	currentLink := filepath.Join(installDir, CurrentLinkName)
+
+	err = runInstall(t, map[string]string{
+		"install-path": installDir,
+		"package-path": writePackage(t, root, map[string]string{"version.txt": "1"}),
+		"layout":       layoutVersioned,
+		"version":      "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = runInstall(t, map[string]string{
+		"install-path": installDir,
+		"package-path": writePackage(t, root, map[string]string{"version.txt": "2"}),
+		"layout":       layoutVersioned,
+		"version":      "2",
+		"fail":         "true",
+	})
+
+	if code := exitCode(err); code != exitCodeRolledBack {
+		t.Errorf("exit code %v, expected %v (%v)", code, exitCodeRolledBack, err)
+	}
+
+	checkTree(t, currentLink, map[string]string{"version.txt": "1"})
+
+	if _, err := os.Stat(filepath.Join(installDir, VersionsDirName, "2")); !os.IsNotExist(err) {
+		t.Errorf("failed version was not removed")
+	}
+}
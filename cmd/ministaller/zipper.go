@@ -8,7 +8,7 @@ import (
 	"path/filepath"
 )
 
-func Unzip(src, dest string) error {
+func Unzip(src, dest string, pr *ProgressReporter) error {
 	log.Printf("Extracting %v into %v", src, dest)
 
 	r, err := zip.OpenReader(src)
@@ -16,6 +16,14 @@ func Unzip(src, dest string) error {
 		return err
 	}
 
+	var total uint64
+	for _, f := range r.File {
+		total += f.UncompressedSize64
+	}
+
+	pr.startPhase(PhaseExtract, total)
+	progress := &ProgressWriter{pr}
+
 	defer func() {
 		if err := r.Close(); err != nil {
 			panic(err)
@@ -51,7 +59,7 @@ func Unzip(src, dest string) error {
 				}
 			}()
 
-			_, err = io.Copy(f, rc)
+			_, err = io.Copy(f, io.TeeReader(rc, progress))
 			if err != nil {
 				return err
 			}